@@ -1,37 +1,65 @@
 package app
 
 import (
-	"agent/env"
+	"agent/pkg/auth"
+	"fmt"
 	"github.com/gogf/gf/frame/g"
 	"github.com/gogf/gf/net/ghttp"
-	"github.com/gogf/gf/os/gcache"
+	"github.com/gogf/gf/util/gvalid"
 	"github.com/osgochina/dmicro/logger"
 )
 
 type UserCheck struct {
-	Username string `json:"username" v:"required#请传入用户账号名称，只包含英文和数字"`                // 用户名，必须是以英文字母开头的字符串，可以包含的字符只有英文和数字
-	Password string `json:"password" v:"password2#请传入正确格式的密码，长度6-18之间，必须包含大小写字母和数字"` // 登录密码
+	Username string `json:"username" v:"required|regex:^[a-zA-Z][a-zA-Z0-9_.-]{0,31}$#请传入用户账号名称|用户账号名称必须以英文字母开头，只包含英文、数字和_.-"` // 用户名，必须是以英文字母开头的字符串，可以包含的字符只有英文、数字和_.-
+	Password string `json:"passwd" v:"required|length:1,128#请传入密码|密码长度必须在1-128之间"`                                             // 登录密码
 }
 
 type ControllerApiV1 struct{}
 
-// Login 登录
+// Login 登录，使用配置的认证后端校验用户名密码，jwt后端通过Authorization头传入token
 func (that *ControllerApiV1) Login(r *ghttp.Request) {
-
-	username := r.GetString("username")
-	passwd := r.GetString("passwd")
-	if len(username) <= 0 || len(passwd) <= 0 {
-		FailJson(true, r, "用户名或密码错误")
+	credential := &auth.Credential{Token: bearerToken(r)}
+	if len(credential.Token) <= 0 {
+		userCheck := new(UserCheck)
+		if err := r.Parse(userCheck); err != nil {
+			if e, ok := err.(gvalid.Error); ok {
+				FailJson(true, r, e.FirstString())
+				return
+			}
+			FailJson(true, r, err.Error())
+			return
+		}
+		credential.Username = userCheck.Username
+		credential.Password = userCheck.Password
+	}
+	ip := r.GetRemoteIp()
+	if remain := loginGuards.Blocked(ip, credential.Username); remain > 0 {
+		logger.Warningf("登录被拒绝, ip:%s, username:%s, 剩余拒绝时长:%s", ip, credential.Username, remain)
+		FailJson(true, r, fmt.Sprintf("登录失败次数过多，请%d秒后重试", int(remain.Seconds())+1))
 		return
 	}
-	if username != env.UserName() || passwd != env.Password() {
+	identity, err := sandbox.authenticator.Authenticate(credential)
+	if err != nil {
+		loginGuards.Fail(ip, credential.Username)
+		logger.Warningf("登录失败, ip:%s, username:%s, backend:%s, err:%v",
+			ip, credential.Username, sandbox.authenticator.Name(), err)
 		FailJson(true, r, "用户名或密码错误")
 		return
 	}
-	uid := 1000
-	err := r.Session.Set("username", username)
-	err = r.Session.Set("uid", uid)
-	_ = r.Session.Set("isLogin", true)
+	loginGuards.Success(ip, credential.Username)
+	err = r.Session.Set("username", identity.Username)
+	if err == nil {
+		err = r.Session.Set("uid", identity.Uid)
+	}
+	if err == nil {
+		err = r.Session.Set("backend", identity.Backend)
+	}
+	if err == nil {
+		err = r.Session.Set("role", string(newVisitor(identity).Role))
+	}
+	if err == nil {
+		err = r.Session.Set("isLogin", true)
+	}
 	if err != nil {
 		FailJson(true, r, err.Error())
 		return
@@ -49,62 +77,9 @@ func (that *ControllerApiV1) Logout(r *ghttp.Request) {
 	SusJson(true, r, "退出成功")
 }
 
-// Share 通过分享链接中的token，获取vnc链接信息
-func (that *ControllerApiV1) Share(r *ghttp.Request) {
-	token := r.GetString("token")
-	if len(token) <= 0 {
-		FailJson(true, r, "获取token失败")
-		return
-	}
-	data, err := gcache.Get(token)
-	if err != nil {
-		logger.Warning(err)
-		FailJson(true, r, "获取token信息失败")
-		return
-	}
-	if data == nil {
-		FailJson(true, r, "获取token信息失败")
-		return
-	}
-	shareConnParams, ok := data.(*ShareConnParams)
-	if !ok {
-		FailJson(true, r, "获取token信息失败")
-		return
-	}
-	params, err := gcache.Get(shareConnParams.Token)
-	if err != nil {
-		logger.Warning(err)
-		FailJson(true, r, "获取params信息失败")
-		return
-	}
-	if data == nil {
-		FailJson(true, r, "获取params信息失败")
-		return
-	}
-	p, ok := params.(*VncConnParams)
-	if !ok {
-		FailJson(true, r, "获取params信息失败")
-		return
-	}
-	logger.Infof("分享桌面：%v", shareConnParams)
-	d := g.Map{
-		"token":    p.Token,
-		"nickname": shareConnParams.Nickname,
-		"host":     g.Cfg().GetString("base_url"),
-		"path":     "/proxy/v1/websockify",
-		"passwd":   p.VncPasswd,
-		"rw":       shareConnParams.RW,
-	}
-	SusJson(true, r, "ok", d)
-}
-
 // Join 加入到实训机
 func (that *ControllerApiV1) Join(r *ghttp.Request) {
-	uid := r.Session.GetInt("uid", 0)
-	if uid <= 0 {
-		FailJson(true, r, "请登录")
-		return
-	}
+	requirePermission(r, PermControl)
 	userComputerId := r.GetInt("user_computer_id", 0)
 	if userComputerId <= 0 {
 		FailJson(true, r, "请选择要登录的实训机")
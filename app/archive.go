@@ -0,0 +1,164 @@
+package app
+
+import (
+	"agent/pkg/safepath"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/os/gfile"
+	"github.com/osgochina/dmicro/logger"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// 目录下载支持的打包格式
+const (
+	ArchiveFormatZip   = "zip"
+	ArchiveFormatTarGz = "tar.gz"
+)
+
+// 打包格式对应的Content-Type
+var archiveContentTypes = map[string]string{
+	ArchiveFormatZip:   "application/zip",
+	ArchiveFormatTarGz: "application/gzip",
+}
+
+// archiveEntry 打包时的一个文件或目录
+type archiveEntry struct {
+	// 在压缩包中的路径
+	name string
+	// 实际读取的文件相对于rootDir的路径，软链接时是链接的目标
+	path string
+	info os.FileInfo
+}
+
+// 遍历目录，生成需要打包的文件列表
+// 每个文件都必须在rootDir中，指向rootDir之外或者指向目录的软链接会被跳过
+func walkArchiveEntries(rootDir string, dir string, fn func(entry *archiveEntry) error) error {
+	base := gfile.Basename(dir)
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.Warningf("打包时读取[%s]失败:%v", path, err)
+			return nil
+		}
+		if !safepath.Within(rootDir, path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry := &archiveEntry{
+			name: filepath.ToSlash(filepath.Join(base, rel)),
+			path: safepath.Rel(rootDir, path),
+			info: info,
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, e := safepath.Resolve(rootDir, entry.path)
+			if e != nil {
+				logger.Warningf("打包时跳过指向目录之外的软链接[%s]", path)
+				return nil
+			}
+			targetInfo, e := os.Stat(target)
+			if e != nil || !targetInfo.Mode().IsRegular() {
+				return nil
+			}
+			entry.path = safepath.Rel(rootDir, target)
+			entry.info = targetInfo
+		}
+		if !entry.info.IsDir() && !entry.info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+// 把文件内容复制到压缩包中，size小于0时复制全部内容
+// 通过safepath打开文件，遍历之后文件被替换成软链接也不会读到rootDir之外的内容
+func copyArchiveFile(w io.Writer, rootDir string, name string, size int64) error {
+	f, err := safepath.OpenFile(rootDir, name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if size < 0 {
+		_, err = io.Copy(w, f)
+		return err
+	}
+	// tar的header中已经写入了长度，打包过程中文件被修改也只能写入这么多
+	_, err = io.CopyN(w, f, size)
+	return err
+}
+
+// streamZip 以zip格式把目录写入w，边读边写，不生成临时文件
+func streamZip(w io.Writer, rootDir string, dir string) error {
+	zw := zip.NewWriter(w)
+	err := walkArchiveEntries(rootDir, dir, func(entry *archiveEntry) error {
+		header, err := zip.FileInfoHeader(entry.info)
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+		if entry.info.IsDir() {
+			header.Name += "/"
+			_, err = zw.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		return copyArchiveFile(fw, rootDir, entry.path, -1)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// streamTarGz 以tar.gz格式把目录写入w，边读边写，不生成临时文件
+func streamTarGz(w io.Writer, rootDir string, dir string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := walkArchiveEntries(rootDir, dir, func(entry *archiveEntry) error {
+		header, err := tar.FileInfoHeader(entry.info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = entry.name
+		if entry.info.IsDir() {
+			header.Name += "/"
+		}
+		// 不暴露文件在服务器上的所有者
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.info.IsDir() {
+			return nil
+		}
+		return copyArchiveFile(tw, rootDir, entry.path, header.Size)
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// streamArchive 按照格式把目录打包写入w
+func streamArchive(w io.Writer, format string, rootDir string, dir string) error {
+	switch format {
+	case ArchiveFormatZip:
+		return streamZip(w, rootDir, dir)
+	case ArchiveFormatTarGz:
+		return streamTarGz(w, rootDir, dir)
+	}
+	return gerror.Newf("不支持的打包格式:%s", format)
+}
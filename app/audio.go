@@ -0,0 +1,172 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/desktop"
+	"agent/pkg/fsuser"
+	"bytes"
+	"fmt"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/os/genv"
+	"github.com/gogf/gf/text/gstr"
+	"github.com/osgochina/dmicro/logger"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// opus编码允许的码率范围，单位bps
+const (
+	minAudioBitrate = 6000
+	maxAudioBitrate = 510000
+)
+
+// 每个websocket消息最多包含的声音数据，pcm格式时约20ms
+const audioFrameSize = 3840
+
+// 启动之后的声音服务，未启动时为nil
+var pulseAudio *desktop.PulseAudio
+
+// 启动桌面的声音服务，需要在启动桌面之前调用，桌面中的程序通过PULSE_SERVER连接声音服务
+func startAudio() error {
+	if !env.AudioEnable() {
+		return nil
+	}
+	cred, err := fsuser.Lookup(env.User())
+	if err != nil {
+		return err
+	}
+	// 运行目录只允许桌面用户访问，声音服务不校验连接者的身份
+	dir := env.AudioRuntimeDir()
+	if err = ensureRuntimeDir(dir, cred.Uid, cred.Gid); err != nil {
+		return err
+	}
+	pa := desktop.NewPulseAudio(dir)
+	pa.SetUser(env.User())
+	pa.SetLogPath(filepath.Join(dir, "pulseaudio.log"))
+	procEntry, err := pa.NewProcess()
+	if err != nil {
+		return err
+	}
+	entry, err := sandbox.ProcManager().NewProcessByEntry(procEntry)
+	if err != nil {
+		return err
+	}
+	entry.Start(false)
+	_ = genv.Set("PULSE_SERVER", pa.Server())
+	pulseAudio = pa
+	return nil
+}
+
+// 创建只属于桌面用户的运行目录
+// 目录默认在/tmp下，其他用户可以提前创建同名的目录或者软链接，所以通过O_NOFOLLOW打开目录，
+// 只接受root或者桌面用户所有的目录，之后通过fd修改所有者和权限，避免跟随软链接修改其他文件
+func ensureRuntimeDir(dir string, uid, gid int) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("创建目录[%s]失败,err:%v", dir, err)
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("打开目录[%s]失败,不是目录或者是软链接,err:%v", dir, err)
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Uid != 0 && int(st.Uid) != uid {
+		return fmt.Errorf("目录[%s]的所有者不正确", dir)
+	}
+	if err = syscall.Fchown(fd, uid, gid); err != nil {
+		return err
+	}
+	return syscall.Fchmod(fd, 0700)
+}
+
+// audioStreamInfo 连接之后首先发送的声音格式说明，之后的二进制消息都是声音数据
+type audioStreamInfo struct {
+	Codec string `json:"codec"`
+	// opus编码时为封装格式的MIME类型，可以直接交给MediaSource
+	Mime       string `json:"mime,omitempty"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+	Bitrate    int    `json:"bitrate,omitempty"`
+}
+
+// 桌面声音的推送通道
+// codec指定编码格式，opus(默认)或pcm；opus编码时container指定封装格式，webm(默认)或ogg，bitrate指定码率
+// 连接后先发送一个json格式的audioStreamInfo文本消息，之后以二进制消息持续发送声音数据，pcm格式为s16le交错存储
+func audioWebSocket(r *ghttp.Request) {
+	if pulseAudio == nil {
+		r.Response.WriteStatusExit(http.StatusServiceUnavailable)
+		return
+	}
+	info := &audioStreamInfo{
+		Codec:      r.GetString("codec", desktop.AudioCodecOpus),
+		SampleRate: desktop.AudioSampleRate,
+		Channels:   desktop.AudioChannels,
+	}
+	container := r.GetString("container", desktop.AudioContainerWebm)
+	if info.Codec == desktop.AudioCodecOpus {
+		info.Bitrate = r.GetInt("bitrate", env.AudioBitrate())
+		if info.Bitrate < minAudioBitrate || info.Bitrate > maxAudioBitrate {
+			r.Response.WriteStatusExit(http.StatusBadRequest, fmt.Sprintf("bitrate必须在%d到%d之间", minAudioBitrate, maxAudioBitrate))
+			return
+		}
+		info.Mime = fmt.Sprintf("audio/%s;codecs=opus", container)
+	}
+	cmd, err := pulseAudio.RecordCommand(info.Codec, container, info.Bitrate)
+	if err != nil {
+		r.Response.WriteStatusExit(http.StatusBadRequest, err.Error())
+		return
+	}
+	visitor := currentVisitor(r)
+	serveWebSocket(r, func(ws *websocket.Conn) {
+		defer ws.Close()
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			logger.Warning(err)
+			return
+		}
+		stderr := new(bytes.Buffer)
+		cmd.Stderr = stderr
+		if err = cmd.Start(); err != nil {
+			logger.Warningf("启动声音录制失败:%v", err)
+			return
+		}
+		logger.Infof("开始推送声音, username:%s, codec:%s", visitor.Username, info.Codec)
+		defer func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			if msg := gstr.Trim(stderr.String()); len(msg) > 0 {
+				logger.Debugf("声音录制进程输出:%s", msg)
+			}
+			logger.Infof("停止推送声音, username:%s", visitor.Username)
+		}()
+		if err = websocket.JSON.Send(ws, info); err != nil {
+			return
+		}
+		// 客户端不会发送消息，读取失败说明连接已经断开，结束录制进程
+		go func() {
+			var msg []byte
+			for websocket.Message.Receive(ws, &msg) == nil {
+			}
+			_ = cmd.Process.Kill()
+		}()
+		buf := make([]byte, audioFrameSize)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				if e := websocket.Message.Send(ws, buf[:n]); e != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"fmt"
+	"github.com/gogf/gf/os/gfile"
+	"github.com/gogf/gf/test/gtest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnsureRuntimeDir(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base := filepath.Join(gfile.TempDir(), fmt.Sprintf("vprix-runtime-%d", time.Now().UnixNano()))
+		t.Assert(os.Mkdir(base, 0700), nil)
+		defer os.RemoveAll(base)
+		uid, gid := os.Getuid(), os.Getgid()
+
+		dir := filepath.Join(base, "pulse")
+		t.Assert(ensureRuntimeDir(dir, uid, gid), nil)
+		fi, err := os.Lstat(dir)
+		t.Assert(err, nil)
+		t.Assert(fi.IsDir(), true)
+		t.Assert(fi.Mode().Perm(), os.FileMode(0700))
+		// 已经存在时修正权限
+		t.Assert(os.Chmod(dir, 0755), nil)
+		t.Assert(ensureRuntimeDir(dir, uid, gid), nil)
+		fi, _ = os.Lstat(dir)
+		t.Assert(fi.Mode().Perm(), os.FileMode(0700))
+
+		// 软链接和普通文件都拒绝，并且不修改软链接指向的目录
+		target := filepath.Join(base, "target")
+		t.Assert(os.Mkdir(target, 0755), nil)
+		link := filepath.Join(base, "link")
+		t.Assert(os.Symlink(target, link), nil)
+		t.AssertNE(ensureRuntimeDir(link, uid, gid), nil)
+		fi, _ = os.Stat(target)
+		t.Assert(fi.Mode().Perm(), os.FileMode(0755))
+		file := filepath.Join(base, "file")
+		t.Assert(gfile.PutContents(file, ""), nil)
+		t.AssertNE(ensureRuntimeDir(file, uid, gid), nil)
+	})
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/auth"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/text/gstr"
+	"github.com/osgochina/dmicro/logger"
+	"net/http"
+)
+
+// 请求上下文中保存访问者的key
+const ctxKeyVisitor = "visitor"
+
+// 不需要登录就可以访问的接口
+var anonymousApis = map[string]bool{
+	"/api/v1/login": true,
+	"/api/v1/share": true,
+}
+
+// MiddlewareAuth 校验/api/v1下接口的登录状态，登录和分享接口除外
+func MiddlewareAuth(r *ghttp.Request) {
+	if r.Method == http.MethodOptions || anonymousApis[gstr.ToLower(r.URL.Path)] {
+		r.Middleware.Next()
+		return
+	}
+	visitor := authenticateRequest(r)
+	if visitor == nil {
+		UnauthenticatedJson(true, r, "请登录")
+		return
+	}
+	r.SetCtxVar(ctxKeyVisitor, visitor)
+	r.Middleware.Next()
+}
+
+// 根据环境变量创建认证后端
+func newAuthenticator() (auth.Authenticator, error) {
+	return auth.New(env.AuthBackend(), &auth.Options{
+		Username:     env.UserName(),
+		Password:     env.Password(),
+		HtpasswdFile: env.HtpasswdFile(),
+		ShadowFile:   "/etc/shadow",
+		DesktopUser:  env.User(),
+		JWTSecret:    env.JWTSecret(),
+		JWTIssuer:    env.JWTIssuer(),
+		JWTAudience:  env.JWTAudience(),
+	})
+}
+
+// 获取请求中携带的bearer token，浏览器发起websocket请求时无法设置header，可以通过access_token参数传入
+// 放在url中的token会被记录到访问日志和Referer中，所以只有websocket升级请求才接受access_token参数
+func bearerToken(r *ghttp.Request) string {
+	header := r.GetHeader("Authorization")
+	if len(header) > 7 && gstr.Equal(header[:7], "Bearer ") {
+		return gstr.Trim(header[7:])
+	}
+	if isWebSocketUpgrade(r) {
+		return r.GetQueryString("access_token")
+	}
+	return ""
+}
+
+// 判断是否是websocket升级请求
+func isWebSocketUpgrade(r *ghttp.Request) bool {
+	return gstr.Equal(r.GetHeader("Upgrade"), "websocket") &&
+		gstr.ContainsI(r.GetHeader("Connection"), "upgrade")
+}
+
+// 获取当前请求的访问者，依次尝试session中的登录信息、bearer token和分享token
+func authenticateRequest(r *ghttp.Request) *Visitor {
+	if r.Session.GetVar("isLogin", false).Bool() {
+		role, ok := ParseRole(r.Session.GetString("role"))
+		if !ok {
+			role = RoleOwner
+		}
+		return &Visitor{
+			Identity: &auth.Identity{
+				Username: r.Session.GetString("username"),
+				Uid:      r.Session.GetInt("uid"),
+				Backend:  r.Session.GetString("backend"),
+			},
+			Role: role,
+		}
+	}
+	if token := bearerToken(r); len(token) > 0 {
+		identity, err := sandbox.authenticator.Authenticate(&auth.Credential{Token: token})
+		if err != nil {
+			return nil
+		}
+		return newVisitor(identity)
+	}
+	if shareToken := r.GetString("share_token"); len(shareToken) > 0 {
+		return shareVisitor(shareToken)
+	}
+	return nil
+}
+
+// 根据认证后端返回的身份生成访问者，后端没有指定角色时认为是桌面的所有者
+func newVisitor(identity *auth.Identity) *Visitor {
+	role, ok := ParseRole(identity.Role)
+	if !ok {
+		role = RoleOwner
+	}
+	return &Visitor{Identity: identity, Role: role}
+}
+
+// 通过分享token生成访问者，分享token只在签发时的vnc服务运行期间有效
+func shareVisitor(shareToken string) *Visitor {
+	shareConnParams, err := shares.Verify(shareToken)
+	if err != nil {
+		logger.Warningf("分享token校验失败:%v", err)
+		return nil
+	}
+	vncConnParams, err := getVncConnParams()
+	if err != nil || shareConnParams.Token != vncConnParams.Token {
+		logger.Warningf("分享token与vnc服务不匹配")
+		return nil
+	}
+	return &Visitor{
+		Identity: &auth.Identity{
+			Username: shareConnParams.Nickname,
+			Uid:      shareConnParams.Uid,
+			Backend:  "share",
+		},
+		Role:  Role(shareConnParams.Role),
+		Share: shareConnParams,
+	}
+}
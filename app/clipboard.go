@@ -0,0 +1,351 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/desktop"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/osgochina/dmicro/logger"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 剪贴板内容的类型
+const (
+	ClipboardTypeText  = "text"
+	ClipboardTypeImage = "image"
+)
+
+// png文件的文件头
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// ClipboardContent 剪贴板的内容
+type ClipboardContent struct {
+	// clipboard 或 primary
+	Selection string `json:"selection"`
+	// text 或 image，为空表示剪贴板为空
+	Type string `json:"type"`
+	// 文本内容，UTF-8编码
+	Content string `json:"content,omitempty"`
+	// 图片内容，png格式，json中为base64编码
+	Data []byte `json:"data,omitempty"`
+}
+
+// 内容的长度
+func (that *ClipboardContent) size() int64 {
+	return int64(len(that.Content) + len(that.Data))
+}
+
+// 内容的摘要，用来判断剪贴板是否变化
+func (that *ClipboardContent) digest() string {
+	h := sha256.New()
+	h.Write([]byte(that.Type))
+	h.Write([]byte{0})
+	h.Write([]byte(that.Content))
+	h.Write(that.Data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// 校验选区名称
+func validSelection(selection string) bool {
+	return selection == desktop.SelectionClipboard || selection == desktop.SelectionPrimary
+}
+
+// clipboardSubscriber 推送通道的一个订阅者
+type clipboardSubscriber struct {
+	ch chan *ClipboardContent
+	// 订阅的选区
+	selections map[string]bool
+}
+
+// clipboardManager 读写桌面的剪贴板，并把桌面中剪贴板的变化推送给订阅者
+// X没有简单的方式通知选区变化，只在有订阅者时定时检查
+type clipboardManager struct {
+	xclip       *desktop.XClip
+	mu          sync.Mutex
+	subscribers map[*clipboardSubscriber]struct{}
+	// 每个选区最后一次的内容摘要
+	last map[string]string
+	stop chan struct{}
+}
+
+var clipboard = newClipboardManager()
+
+func newClipboardManager() *clipboardManager {
+	return &clipboardManager{
+		xclip:       desktop.NewXClip(),
+		subscribers: make(map[*clipboardSubscriber]struct{}),
+		last:        make(map[string]string),
+	}
+}
+
+// Read 读取选区的内容，选区中有图片时优先返回图片
+func (that *clipboardManager) Read(selection string) (*ClipboardContent, error) {
+	targets, err := that.xclip.Targets(selection)
+	if err != nil {
+		return nil, err
+	}
+	content := &ClipboardContent{Selection: selection}
+	has := make(map[string]bool)
+	for _, t := range targets {
+		has[t] = true
+	}
+	maxSize := env.ClipboardMaxSize()
+	switch {
+	case has[desktop.TargetPNG]:
+		content.Data, err = that.xclip.Read(selection, desktop.TargetPNG, maxSize)
+		content.Type = ClipboardTypeImage
+	case has[desktop.TargetUTF8] || has["STRING"] || has["TEXT"]:
+		var data []byte
+		data, err = that.xclip.Read(selection, desktop.TargetUTF8, maxSize)
+		content.Content = string(data)
+		content.Type = ClipboardTypeText
+	}
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Write 把内容写入选区，并通知from之外的其他订阅者
+func (that *clipboardManager) Write(content *ClipboardContent, from *clipboardSubscriber) error {
+	if !validSelection(content.Selection) {
+		return gerror.New("选区不正确")
+	}
+	if content.size() > env.ClipboardMaxSize() {
+		return gerror.Newf("剪贴板内容不能超过%d字节", env.ClipboardMaxSize())
+	}
+	var err error
+	switch content.Type {
+	case ClipboardTypeText:
+		content.Data = nil
+		err = that.xclip.Write(content.Selection, desktop.TargetUTF8, []byte(content.Content))
+	case ClipboardTypeImage:
+		if !bytes.HasPrefix(content.Data, pngSignature) {
+			return gerror.New("图片必须是png格式")
+		}
+		content.Content = ""
+		err = that.xclip.Write(content.Selection, desktop.TargetPNG, content.Data)
+	default:
+		return gerror.New("不支持的剪贴板类型")
+	}
+	if err != nil {
+		return err
+	}
+	that.mu.Lock()
+	that.last[content.Selection] = content.digest()
+	that.mu.Unlock()
+	that.publish(content, from)
+	return nil
+}
+
+// 把内容推送给订阅了该选区的订阅者，订阅者处理不过来时丢弃
+func (that *clipboardManager) publish(content *ClipboardContent, from *clipboardSubscriber) {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	for sub := range that.subscribers {
+		if sub == from || !sub.selections[content.Selection] {
+			continue
+		}
+		select {
+		case sub.ch <- content:
+		default:
+		}
+	}
+}
+
+// Subscribe 订阅剪贴板的变化，第一个订阅者出现时开始检查剪贴板
+func (that *clipboardManager) Subscribe(selections ...string) *clipboardSubscriber {
+	sub := &clipboardSubscriber{
+		ch:         make(chan *ClipboardContent, 4),
+		selections: make(map[string]bool),
+	}
+	for _, s := range selections {
+		sub.selections[s] = true
+	}
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	that.subscribers[sub] = struct{}{}
+	if that.stop == nil {
+		that.stop = make(chan struct{})
+		go that.poll(that.stop)
+	}
+	return sub
+}
+
+// Unsubscribe 取消订阅，没有订阅者时停止检查剪贴板
+func (that *clipboardManager) Unsubscribe(sub *clipboardSubscriber) {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	delete(that.subscribers, sub)
+	if len(that.subscribers) == 0 && that.stop != nil {
+		close(that.stop)
+		that.stop = nil
+	}
+}
+
+// 当前被订阅的选区
+func (that *clipboardManager) watchedSelections() []string {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	watched := make(map[string]bool)
+	for sub := range that.subscribers {
+		for s := range sub.selections {
+			watched[s] = true
+		}
+	}
+	var selections []string
+	for _, s := range []string{desktop.SelectionClipboard, desktop.SelectionPrimary} {
+		if watched[s] {
+			selections = append(selections, s)
+		}
+	}
+	return selections
+}
+
+// 定时检查剪贴板，内容变化时推送给订阅者
+func (that *clipboardManager) poll(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(env.ClipboardPollInterval()) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, selection := range that.watchedSelections() {
+			content, err := that.Read(selection)
+			if err != nil {
+				logger.Debugf("读取剪贴板[%s]失败:%v", selection, err)
+				continue
+			}
+			digest := content.digest()
+			that.mu.Lock()
+			changed := that.last[selection] != digest
+			that.last[selection] = digest
+			that.mu.Unlock()
+			if changed {
+				that.publish(content, nil)
+			}
+		}
+	}
+}
+
+// Clipboard 读写桌面的剪贴板
+// GET请求读取，selection指定选区，默认clipboard，图片直接返回png
+// POST请求写入，type为text时读取content参数，type为image时读取上传的png文件file
+func (that *ControllerApiV1) Clipboard(r *ghttp.Request) {
+	requirePermission(r, PermClipboard)
+	selection := r.GetString("selection", desktop.SelectionClipboard)
+	if !validSelection(selection) {
+		FailJson(true, r, "选区不正确")
+		return
+	}
+	if r.Method == http.MethodGet {
+		content, err := clipboard.Read(selection)
+		if err != nil {
+			logger.Warning(err)
+			FailJson(true, r, err.Error())
+			return
+		}
+		if content.Type == ClipboardTypeImage && r.GetString("format") != "json" {
+			r.Response.Header().Set("Content-Type", desktop.TargetPNG)
+			r.Response.Write(content.Data)
+			return
+		}
+		SusJson(true, r, "ok", content)
+		return
+	}
+	content := &ClipboardContent{Selection: selection, Type: r.GetString("type", ClipboardTypeText)}
+	switch content.Type {
+	case ClipboardTypeText:
+		content.Content = r.GetString("content")
+	case ClipboardTypeImage:
+		file := r.GetUploadFile("file")
+		if file == nil {
+			FailJson(true, r, "获取图片失败")
+			return
+		}
+		if file.Size > env.ClipboardMaxSize() {
+			FailJson(true, r, fmt.Sprintf("剪贴板内容不能超过%d字节", env.ClipboardMaxSize()))
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			FailJson(true, r, err.Error())
+			return
+		}
+		content.Data, err = ioutil.ReadAll(io.LimitReader(f, env.ClipboardMaxSize()+1))
+		_ = f.Close()
+		if err != nil {
+			FailJson(true, r, err.Error())
+			return
+		}
+	}
+	if err := clipboard.Write(content, nil); err != nil {
+		FailJson(true, r, err.Error())
+		return
+	}
+	SusJson(true, r, "ok")
+}
+
+// 剪贴板的推送通道
+// 连接后先推送当前内容，之后桌面剪贴板变化时推送ClipboardContent，客户端发送ClipboardContent写入桌面剪贴板
+// 默认只同步clipboard选区，primary=true时同时同步primary选区
+func clipboardWebSocket(r *ghttp.Request) {
+	visitor := currentVisitor(r)
+	if visitor == nil || !visitor.Role.Can(PermClipboard) {
+		r.Response.WriteStatusExit(http.StatusForbidden)
+		return
+	}
+	selections := []string{desktop.SelectionClipboard}
+	if r.GetBool("primary") {
+		selections = append(selections, desktop.SelectionPrimary)
+	}
+	serveWebSocket(r, func(ws *websocket.Conn) {
+		defer ws.Close()
+		// base64编码之后长度会变大
+		ws.MaxPayloadBytes = int(env.ClipboardMaxSize()*4/3) + 4096
+		sub := clipboard.Subscribe(selections...)
+		defer clipboard.Unsubscribe(sub)
+		for _, selection := range selections {
+			if content, err := clipboard.Read(selection); err == nil {
+				if err = websocket.JSON.Send(ws, content); err != nil {
+					return
+				}
+			}
+		}
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				content := new(ClipboardContent)
+				if err := websocket.JSON.Receive(ws, content); err != nil {
+					return
+				}
+				if err := clipboard.Write(content, sub); err != nil {
+					logger.Warningf("同步剪贴板失败, username:%s, err:%v", visitor.Username, err)
+					_ = websocket.JSON.Send(ws, map[string]string{"error": err.Error()})
+				}
+			}
+		}()
+		for {
+			select {
+			case <-closed:
+				return
+			case content := <-sub.ch:
+				if err := websocket.JSON.Send(ws, content); err != nil {
+					logger.Debugf("推送剪贴板失败:%v", err)
+					return
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"agent/pkg/desktop"
+	"github.com/gogf/gf/test/gtest"
+	"testing"
+)
+
+func TestClipboardManager_publish(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		m := newClipboardManager()
+		newSub := func(selections ...string) *clipboardSubscriber {
+			sub := &clipboardSubscriber{ch: make(chan *ClipboardContent, 1), selections: make(map[string]bool)}
+			for _, s := range selections {
+				sub.selections[s] = true
+			}
+			m.subscribers[sub] = struct{}{}
+			return sub
+		}
+		from := newSub(desktop.SelectionClipboard)
+		other := newSub(desktop.SelectionClipboard)
+		primary := newSub(desktop.SelectionPrimary)
+
+		content := &ClipboardContent{Selection: desktop.SelectionClipboard, Type: ClipboardTypeText, Content: "hello"}
+		m.publish(content, from)
+		// 写入者自己和没有订阅该选区的订阅者不会收到
+		t.Assert(len(from.ch), 0)
+		t.Assert(len(primary.ch), 0)
+		t.Assert(<-other.ch, content)
+
+		// 订阅者处理不过来时丢弃，不会阻塞
+		m.publish(content, nil)
+		m.publish(content, nil)
+		t.Assert(len(other.ch), 1)
+	})
+}
+
+func TestClipboardContent_digest(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		text := &ClipboardContent{Type: ClipboardTypeText, Content: "a"}
+		image := &ClipboardContent{Type: ClipboardTypeImage, Data: []byte("a")}
+		t.AssertNE(text.digest(), image.digest())
+		t.Assert(text.digest(), (&ClipboardContent{Type: ClipboardTypeText, Content: "a"}).digest())
+	})
+}
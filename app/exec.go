@@ -0,0 +1,414 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/customexec"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/os/gfile"
+	"github.com/gogf/gf/util/gvalid"
+	"github.com/osgochina/dmicro/logger"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 执行命令的身份
+const (
+	ExecUserDesktop = "desktop"
+	ExecUserRoot    = "root"
+)
+
+// 执行命令时输出的事件类型
+const (
+	ExecEventStdout = "stdout"
+	ExecEventStderr = "stderr"
+	ExecEventExit   = "exit"
+	ExecEventError  = "error"
+)
+
+// ExecRequest 执行命令的参数
+type ExecRequest struct {
+	// 通过/bin/sh -c执行的命令
+	Command string `json:"command" v:"required#请传入要执行的命令"`
+	// 执行命令的身份，desktop(默认)或root
+	User string `json:"user"`
+	// 工作目录，默认为家目录
+	Cwd string `json:"cwd"`
+	// 追加的环境变量，格式为KEY=VALUE
+	Env []string `json:"env"`
+	// 超时时间，单位秒，超时后结束整个进程组
+	Timeout int `json:"timeout"`
+	// 写入标准输入的内容
+	Stdin string `json:"stdin"`
+}
+
+// ExecEvent 流式输出的事件
+type ExecEvent struct {
+	Type string `json:"type"`
+	// stdout、stderr的内容，error的错误信息，非UTF-8的字符会被替换
+	Data string `json:"data,omitempty"`
+	// exit事件的退出码，被信号结束时为-1
+	ExitCode int `json:"exitCode"`
+	// exit事件是否因为超时被结束
+	Timeout bool `json:"timeout,omitempty"`
+	// exit事件的执行时长，单位毫秒
+	Duration int64 `json:"duration,omitempty"`
+}
+
+// ExecResult 非流式执行的结果
+type ExecResult struct {
+	ExitCode int    `json:"exitCode"`
+	Timeout  bool   `json:"timeout"`
+	Duration int64  `json:"duration"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// 输出超过限制被截断
+	Truncated bool `json:"truncated"`
+}
+
+// 校验参数并补充默认值
+func (that *ExecRequest) check() error {
+	switch that.User {
+	case "", ExecUserDesktop:
+		that.User = ExecUserDesktop
+	case ExecUserRoot:
+		if !env.ExecAllowRoot() {
+			return gerror.New("不允许以root身份执行命令")
+		}
+	default:
+		return gerror.New("user参数只能是desktop或root")
+	}
+	if len(that.Cwd) == 0 {
+		that.Cwd = env.Home()
+	}
+	if !gfile.IsDir(that.Cwd) {
+		return gerror.New("工作目录不存在")
+	}
+	for _, kv := range that.Env {
+		if pos := strings.Index(kv, "="); pos <= 0 {
+			return gerror.Newf("环境变量格式错误:%s", kv)
+		}
+	}
+	if that.Timeout <= 0 {
+		that.Timeout = env.ExecTimeout()
+	}
+	if that.Timeout > env.ExecMaxTimeout() {
+		return gerror.Newf("超时时间不能超过%d秒", env.ExecMaxTimeout())
+	}
+	return nil
+}
+
+// 创建命令，在独立的进程组中执行，超时或取消时结束整个进程组
+// 只传入最小的环境变量和请求中追加的环境变量，无法切换到桌面用户时返回错误，不能以root身份执行
+func (that *ExecRequest) command() (*customexec.Cmd, error) {
+	cmd := customexec.Command("/bin/sh", "-c", that.Command)
+	cmd.Dir = that.Cwd
+	if that.User == ExecUserRoot {
+		cmd.Env = customexec.UserEnv("root", that.Env...)
+	} else {
+		cmd.Env = customexec.UserEnv(env.User(), that.Env...)
+		if err := cmd.SetUser(); err != nil {
+			return nil, gerror.Wrapf(err, "切换到桌面用户[%s]失败", env.User())
+		}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return cmd, nil
+}
+
+// 执行命令，输出通过emit按顺序回调，stdin为nil时使用请求中的stdin参数，ctx取消时结束命令
+func runCommand(ctx context.Context, req *ExecRequest, stdin io.Reader, emit func(*ExecEvent)) error {
+	cmd, err := req.command()
+	if err != nil {
+		return err
+	}
+	if stdin == nil {
+		stdin = strings.NewReader(req.Stdin)
+	}
+	// 自己复制标准输入，避免stdin一直没有数据时Wait无法返回
+	stdinPipe, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(stdinPipe, stdin)
+		_ = stdinPipe.Close()
+	}()
+	var mu sync.Mutex
+	send := func(event *ExecEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		emit(event)
+	}
+	var timedOut bool
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(time.Duration(req.Timeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			mu.Lock()
+			timedOut = true
+			mu.Unlock()
+		case <-ctx.Done():
+		}
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}()
+	var wg sync.WaitGroup
+	pipe := func(typ string, r io.Reader) {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		var pending []byte
+		for {
+			n, err := r.Read(buf)
+			data := append(pending, buf[:n]...)
+			// 被截断的UTF-8字符留到下一次和后面的内容一起发送
+			if err == nil {
+				complete := trimIncompleteUTF8(data)
+				pending = append([]byte(nil), data[len(complete):]...)
+				data = complete
+			}
+			if len(data) > 0 {
+				send(&ExecEvent{Type: typ, Data: string(data)})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go pipe(ExecEventStdout, stdout)
+	go pipe(ExecEventStderr, stderr)
+	// 必须读完输出之后再Wait，Wait会关闭管道
+	wg.Wait()
+	err = cmd.Wait()
+	close(done)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+	}
+	mu.Lock()
+	event := &ExecEvent{
+		Type:     ExecEventExit,
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Timeout:  timedOut,
+		Duration: time.Since(start).Milliseconds(),
+	}
+	mu.Unlock()
+	send(event)
+	return nil
+}
+
+// 解析执行命令的参数，失败时返回错误信息
+func parseExecRequest(r *ghttp.Request) *ExecRequest {
+	req := new(ExecRequest)
+	if err := r.Parse(req); err != nil {
+		if e, ok := err.(gvalid.Error); ok {
+			FailJson(true, r, e.FirstString())
+			return nil
+		}
+		FailJson(true, r, err.Error())
+		return nil
+	}
+	if err := req.check(); err != nil {
+		FailJson(true, r, err.Error())
+		return nil
+	}
+	return req
+}
+
+// 限制长度的输出缓存
+type execOutput struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (that *execOutput) write(data string) {
+	if remain := that.limit - that.buf.Len(); len(data) > remain {
+		data = data[:remain]
+		that.truncated = true
+	}
+	that.buf.WriteString(data)
+}
+
+// Exec 执行命令
+// stream=true时以chunked方式逐行返回json格式的ExecEvent，最后一行为exit事件；否则等待命令结束后返回ExecResult
+// 登录状态保存在cookie中，为了防止其他网站借用浏览器的登录状态执行命令，不允许跨域的请求
+func (that *ControllerApiV1) Exec(r *ghttp.Request) {
+	if !checkOrigin(r.Request) {
+		logger.Warningf("拒绝跨域执行命令, origin:%s", r.GetHeader("Origin"))
+		r.Response.WriteStatusExit(http.StatusForbidden)
+		return
+	}
+	requirePermission(r, PermExec)
+	req := parseExecRequest(r)
+	visitor := currentVisitor(r)
+	logger.Infof("执行命令, username:%s, user:%s, cwd:%s, command:%s", visitor.Username, req.User, req.Cwd, req.Command)
+	if r.GetBool("stream") {
+		execStream(r, req)
+		return
+	}
+	result := new(ExecResult)
+	stdout := &execOutput{limit: env.ExecMaxOutput()}
+	stderr := &execOutput{limit: env.ExecMaxOutput()}
+	err := runCommand(r.Context(), req, nil, func(event *ExecEvent) {
+		switch event.Type {
+		case ExecEventStdout:
+			stdout.write(event.Data)
+		case ExecEventStderr:
+			stderr.write(event.Data)
+		case ExecEventExit:
+			result.ExitCode = event.ExitCode
+			result.Timeout = event.Timeout
+			result.Duration = event.Duration
+		}
+	})
+	if err != nil {
+		logger.Warningf("执行命令失败:%v", err)
+		FailJson(true, r, err.Error())
+		return
+	}
+	result.Stdout = stdout.buf.String()
+	result.Stderr = stderr.buf.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	SusJson(true, r, "ok", result)
+}
+
+// 以chunked方式返回命令的输出
+func execStream(r *ghttp.Request, req *ExecRequest) {
+	r.Response.Header().Set("Content-Type", "application/x-ndjson")
+	r.Response.Header().Set("X-Content-Type-Options", "nosniff")
+	// 先通过gf发送响应头，之后直接写入底层的ResponseWriter
+	r.Response.WriteHeader(http.StatusOK)
+	r.Response.Flush()
+	writer := r.Response.Writer.RawWriter()
+	flusher, _ := writer.(http.Flusher)
+	encoder := json.NewEncoder(writer)
+	emit := func(event *ExecEvent) {
+		if encoder.Encode(event) == nil && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := runCommand(r.Context(), req, nil, emit); err != nil {
+		logger.Warningf("执行命令失败:%v", err)
+		emit(&ExecEvent{Type: ExecEventError, Data: err.Error()})
+	}
+}
+
+// websocket中等待写入标准输入的消息数量，超过时丢弃新的消息
+const execStdinQueueSize = 256
+
+// execInput websocket中客户端发送的消息
+type execInput struct {
+	// stdin写入标准输入，eof关闭标准输入，kill结束命令
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// 执行命令的websocket通道
+// 连接后客户端先发送一个json格式的ExecRequest，之后可以发送execInput写入标准输入或结束命令，
+// 服务端以json格式的ExecEvent推送输出，最后推送exit事件后关闭连接
+func execWebSocket(r *ghttp.Request) {
+	visitor := currentVisitor(r)
+	if visitor == nil || !visitor.Role.Can(PermExec) {
+		r.Response.WriteStatusExit(http.StatusForbidden)
+		return
+	}
+	serveWebSocket(r, func(ws *websocket.Conn) {
+		defer ws.Close()
+		sendEvent := func(event *ExecEvent) {
+			_ = websocket.JSON.Send(ws, event)
+		}
+		req := new(ExecRequest)
+		if err := websocket.JSON.Receive(ws, req); err != nil {
+			return
+		}
+		if err := gvalid.CheckStruct(r.Context(), req, nil); err != nil {
+			sendEvent(&ExecEvent{Type: ExecEventError, Data: err.FirstString()})
+			return
+		}
+		if err := req.check(); err != nil {
+			sendEvent(&ExecEvent{Type: ExecEventError, Data: err.Error()})
+			return
+		}
+		logger.Infof("执行命令, username:%s, user:%s, cwd:%s, command:%s", visitor.Username, req.User, req.Cwd, req.Command)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stdinReader, stdinWriter := io.Pipe()
+		// 标准输入由单独的goroutine写入管道，命令不读取标准输入时接收消息的循环也不会阻塞，仍然可以处理kill和连接断开
+		// 请求中的stdin最先放入队列，保证在之后的stdin消息和eof之前写入
+		stdinQueue := make(chan []byte, execStdinQueueSize)
+		if len(req.Stdin) > 0 {
+			stdinQueue <- []byte(req.Stdin)
+		}
+		go func() {
+			for data := range stdinQueue {
+				// 命令结束后管道被关闭，写入失败，继续取出剩余的数据直到队列关闭
+				_, _ = stdinWriter.Write(data)
+			}
+			_ = stdinWriter.Close()
+		}()
+		go func() {
+			stdinClosed := false
+			closeStdin := func() {
+				if !stdinClosed {
+					stdinClosed = true
+					close(stdinQueue)
+				}
+			}
+			defer closeStdin()
+			for {
+				input := new(execInput)
+				if err := websocket.JSON.Receive(ws, input); err != nil {
+					// 连接断开时结束命令
+					cancel()
+					return
+				}
+				switch input.Type {
+				case "stdin":
+					if stdinClosed {
+						continue
+					}
+					select {
+					case stdinQueue <- []byte(input.Data):
+					default:
+						sendEvent(&ExecEvent{Type: ExecEventError, Data: "命令没有及时读取标准输入，丢弃了写入的内容"})
+					}
+				case "eof":
+					closeStdin()
+				case "kill":
+					cancel()
+				}
+			}
+		}()
+		if err := runCommand(ctx, req, stdinReader, sendEvent); err != nil {
+			logger.Warningf("执行命令失败:%v", err)
+			sendEvent(&ExecEvent{Type: ExecEventError, Data: err.Error()})
+		}
+		_ = stdinReader.Close()
+	})
+}
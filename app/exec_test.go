@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"github.com/gogf/gf/os/genv"
+	"github.com/gogf/gf/test/gtest"
+	"os"
+	"testing"
+)
+
+// 以root执行命令，收集输出
+func runTestCommand(req *ExecRequest) (stdout string, stderr string, exit *ExecEvent, err error) {
+	if err = genv.Set("VPRIX_AGENT_EXEC_ALLOW_ROOT", "true"); err != nil {
+		return
+	}
+	defer genv.Remove("VPRIX_AGENT_EXEC_ALLOW_ROOT")
+	req.User = ExecUserRoot
+	if err = req.check(); err != nil {
+		return
+	}
+	err = runCommand(context.Background(), req, nil, func(event *ExecEvent) {
+		switch event.Type {
+		case ExecEventStdout:
+			stdout += event.Data
+		case ExecEventStderr:
+			stderr += event.Data
+		case ExecEventExit:
+			exit = event
+		}
+	})
+	return
+}
+
+func TestRunCommand(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		dir := os.TempDir()
+		// agent自己的配置不会传给命令
+		t.Assert(genv.Set("VPRIX_AGENT_LOGIN_PASSWORD", "secret"), nil)
+		defer genv.Remove("VPRIX_AGENT_LOGIN_PASSWORD")
+		stdout, stderr, exit, err := runTestCommand(&ExecRequest{
+			Command: "cat; pwd; echo $FOO$VPRIX_AGENT_LOGIN_PASSWORD >&2; exit 3",
+			Cwd:     dir,
+			Env:     []string{"FOO=bar"},
+			Stdin:   "你好\n",
+		})
+		t.Assert(err, nil)
+		t.Assert(stdout, "你好\n"+dir+"\n")
+		t.Assert(stderr, "bar\n")
+		t.Assert(exit.ExitCode, 3)
+		t.Assert(exit.Timeout, false)
+
+		// 超时后结束整个进程组
+		_, _, exit, err = runTestCommand(&ExecRequest{Command: "sleep 10 & sleep 10", Timeout: 1})
+		t.Assert(err, nil)
+		t.Assert(exit.Timeout, true)
+		t.Assert(exit.ExitCode, -1)
+	})
+}
+
+func TestRunCommandAsDesktopUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("需要root权限切换用户")
+	}
+	gtest.C(t, func(t *gtest.T) {
+		t.Assert(genv.Set("VPRIX_USER", "nobody"), nil)
+		defer genv.Remove("VPRIX_USER")
+		req := &ExecRequest{Command: "id -u; id -G", Cwd: "/"}
+		t.Assert(req.check(), nil)
+		stdout := ""
+		err := runCommand(context.Background(), req, nil, func(event *ExecEvent) {
+			if event.Type == ExecEventStdout {
+				stdout += event.Data
+			}
+		})
+		t.Assert(err, nil)
+		// 只有桌面用户自己的组，不会继承root的附加组
+		t.Assert(stdout, "65534\n65534\n")
+	})
+}
+
+func TestExecRequest_check(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		t.AssertNE((&ExecRequest{Command: "true", User: "nobody"}).check(), nil)
+		t.AssertNE((&ExecRequest{Command: "true", Env: []string{"=x"}}).check(), nil)
+		t.AssertNE((&ExecRequest{Command: "true", Cwd: "/not/exist"}).check(), nil)
+		req := &ExecRequest{Command: "true", Cwd: "/"}
+		t.Assert(req.check(), nil)
+		t.Assert(req.User, ExecUserDesktop)
+		// 默认不允许以root身份执行
+		t.AssertNE((&ExecRequest{Command: "true", User: ExecUserRoot}).check(), nil)
+	})
+}
@@ -1,12 +1,19 @@
 package app
 
 import (
+	"agent/pkg/safepath"
 	"fmt"
 	"github.com/gogf/gf/frame/g"
 	"github.com/gogf/gf/net/ghttp"
-	"github.com/gogf/gf/os/genv"
 	"github.com/gogf/gf/os/gfile"
 	"github.com/gogf/gf/text/gstr"
+	"github.com/osgochina/dmicro/logger"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
 )
 
 type FileInfo struct {
@@ -14,61 +21,318 @@ type FileInfo struct {
 	Name  string `json:"name"`
 	Size  int64  `json:"size"`
 	IsDir bool   `json:"isDir"`
+	// 修改时间，unix时间戳，单位秒
+	ModTime int64 `json:"mtime"`
+	// 权限，例如 -rw-r--r--
+	Mode string `json:"mode"`
+	// 根据扩展名判断的MIME类型，目录为inode/directory
+	Mime string `json:"mime"`
+	// 软链接指向的路径，不是软链接时为空
+	LinkTarget string `json:"linkTarget,omitempty"`
+	// 目录中的文件数量，包括隐藏文件，不是目录时为0
+	ChildCount int `json:"childCount"`
 }
 
-// FileList 展示文件列表信息
-func (that *ControllerApiV1) FileList(r *ghttp.Request) {
-	rootDir := fmt.Sprintf("%s/Downloads", genv.Get("HOME", "/home/vprix-user"))
-	path := r.GetString("path", "/")
-	path = fmt.Sprintf("%s/%s", rootDir, gstr.TrimLeft(path, "/"))
-	path = gfile.Abs(path)
-	if gstr.Pos(path, rootDir) != 0 {
-		FailJson(true, r, "path not found")
-	}
-	// 扫描目录
-	paths, err := gfile.ScanDirFunc(path, "*", false, func(path string) string {
-		if gstr.Pos(gfile.Basename(path), ".") == 0 {
-			return ""
+// FileList 的排序字段
+const (
+	FileSortName  = "name"
+	FileSortSize  = "size"
+	FileSortMtime = "mtime"
+	FileSortType  = "type"
+)
+
+// 单次最多返回的文件数量
+const fileListMaxLimit = 1000
+
+// fileListOptions 文件列表的过滤、排序和分页参数
+type fileListOptions struct {
+	Sort       string
+	Desc       bool
+	Offset     int
+	Limit      int
+	Pattern    string
+	ShowHidden bool
+}
+
+// 列出的一个目录项，排序和分页之后再补充其他信息
+type fileListEntry struct {
+	path string
+	info os.FileInfo
+	// 软链接指向rootDir中的文件时为目标文件的信息
+	target os.FileInfo
+}
+
+// 目录项的实际信息，软链接使用目标文件的信息
+func (that *fileListEntry) stat() os.FileInfo {
+	if that.target != nil {
+		return that.target
+	}
+	return that.info
+}
+
+// 获取文件的MIME类型
+func fileMime(info os.FileInfo) string {
+	if info.IsDir() {
+		return "inode/directory"
+	}
+	if t := mime.TypeByExtension(filepath.Ext(info.Name())); len(t) > 0 {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// 对目录项排序，目录始终排在文件前面
+func sortFileEntries(entries []*fileListEntry, sortBy string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].stat(), entries[j].stat()
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		less, greater := false, false
+		switch sortBy {
+		case FileSortSize:
+			less, greater = a.Size() < b.Size(), a.Size() > b.Size()
+		case FileSortMtime:
+			less, greater = a.ModTime().Before(b.ModTime()), a.ModTime().After(b.ModTime())
+		case FileSortType:
+			ea, eb := gstr.ToLower(filepath.Ext(a.Name())), gstr.ToLower(filepath.Ext(b.Name()))
+			less, greater = ea < eb, ea > eb
+		}
+		if !less && !greater {
+			// 其他字段相同时按名称排序
+			less, greater = entries[i].info.Name() < entries[j].info.Name(), entries[i].info.Name() > entries[j].info.Name()
 		}
-		return path
+		if desc {
+			return greater
+		}
+		return less
 	})
+}
+
+// 列出目录中的文件，返回过滤之后的总数和当前页的文件信息
+func listDir(rootDir string, dir string, opts *fileListOptions) (int, []*FileInfo, error) {
+	dirEntries, err := os.ReadDir(dir)
 	if err != nil {
-		FailJson(true, r, err.Error())
-	}
-	if len(paths) == 0 {
-		SusJson(true, r, "ok", g.Map{})
+		return 0, nil, err
 	}
-	// 迭代路径，生成指定的目录
-	var FileInfos []*FileInfo
-	for _, p := range paths {
-		fileInfo := new(FileInfo)
-		fileInfo.Path = gstr.Replace(p, rootDir, "")
-		fInfo, e := gfile.Info(p)
+	entries := make([]*fileListEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		name := d.Name()
+		if !opts.ShowHidden && gstr.Pos(name, ".") == 0 {
+			continue
+		}
+		if len(opts.Pattern) > 0 {
+			if ok, _ := filepath.Match(opts.Pattern, name); !ok {
+				continue
+			}
+		}
+		info, e := d.Info()
 		if e != nil {
-			FailJson(true, r, e.Error())
+			// 读取目录之后文件被删除
+			continue
+		}
+		entry := &fileListEntry{path: filepath.Join(dir, name), info: info}
+		// 只有指向rootDir中的软链接才展示目标文件的信息，避免泄露rootDir之外的文件信息
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, e := safepath.Resolve(rootDir, safepath.Rel(rootDir, entry.path)); e == nil {
+				entry.target, _ = os.Stat(target)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sortFileEntries(entries, opts.Sort, opts.Desc)
+	total := len(entries)
+	if opts.Offset >= total {
+		entries = nil
+	} else {
+		entries = entries[opts.Offset:]
+	}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+	}
+	fileInfos := make([]*FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info := entry.stat()
+		fileInfo := &FileInfo{
+			Path:    safepath.Rel(rootDir, entry.path),
+			Name:    entry.info.Name(),
+			Size:    info.Size(),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime().Unix(),
+			Mode:    info.Mode().String(),
+			Mime:    fileMime(info),
 		}
-		fileInfo.IsDir = fInfo.IsDir()
-		fileInfo.Name = fInfo.Name()
-		fileInfo.Size = fInfo.Size()
-		FileInfos = append(FileInfos, fileInfo)
+		if entry.info.Mode()&os.ModeSymlink != 0 {
+			fileInfo.LinkTarget, _ = os.Readlink(entry.path)
+			if entry.target == nil {
+				fileInfo.Mime = "inode/symlink"
+			}
+		}
+		if fileInfo.IsDir {
+			if names, e := readDirNames(entry.path); e == nil {
+				fileInfo.ChildCount = len(names)
+			}
+		}
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	return total, fileInfos, nil
+}
+
+// 读取目录中的文件名，不读取文件信息
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// FileList 展示文件列表信息
+// 支持sort(name|size|mtime|type)、order(asc|desc)排序，offset、limit分页，pattern通配符过滤，showHidden显示隐藏文件
+func (that *ControllerApiV1) FileList(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	root := requestFileRoot(r, "root", FileRootDownloads, false)
+	rootDir := root.Path
+	path, err := safepath.Resolve(rootDir, r.GetString("path", "/"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+		return
+	}
+	opts := &fileListOptions{
+		Sort:       r.GetString("sort", FileSortName),
+		Desc:       r.GetString("order") == "desc",
+		Offset:     r.GetInt("offset"),
+		Limit:      r.GetInt("limit"),
+		Pattern:    r.GetString("pattern"),
+		ShowHidden: r.GetBool("showHidden"),
+	}
+	switch opts.Sort {
+	case FileSortName, FileSortSize, FileSortMtime, FileSortType:
+	default:
+		FailJson(true, r, "不支持的排序字段")
+		return
+	}
+	if opts.Offset < 0 || opts.Limit < 0 {
+		FailJson(true, r, "分页参数有误")
+		return
+	}
+	if opts.Limit == 0 || opts.Limit > fileListMaxLimit {
+		opts.Limit = fileListMaxLimit
+	}
+	if _, err = filepath.Match(opts.Pattern, ""); err != nil {
+		FailJson(true, r, "pattern格式错误")
+		return
+	}
+	// 以桌面用户的身份扫描目录，桌面用户没有权限的目录也不能通过接口查看
+	var total int
+	var fileInfos []*FileInfo
+	err = asDesktopUser(func() (e error) {
+		total, fileInfos, e = listDir(rootDir, path, opts)
+		return e
+	})
+	if err != nil {
+		FailJson(true, r, err.Error())
+		return
 	}
-	SusJson(true, r, "ok", FileInfos)
+	SusJson(true, r, "ok", g.Map{
+		"total":  total,
+		"offset": opts.Offset,
+		"limit":  opts.Limit,
+		"list":   fileInfos,
+	})
 }
 
-// Download 下载文件
+// Download 下载文件，文件支持Range断点续传，下载目录时通过format参数指定打包格式，支持zip和tar.gz，默认zip
 func (that *ControllerApiV1) Download(r *ghttp.Request) {
-	rootDir := fmt.Sprintf("%s/Downloads", genv.Get("HOME", "/home/vprix-user"))
-	path := r.GetString("path")
-	path = fmt.Sprintf("%s/%s", rootDir, gstr.TrimLeft(path, "/"))
-	path = gfile.Abs(path)
-	if gstr.Pos(path, rootDir) != 0 {
+	requirePermission(r, PermFileTransfer)
+	root := requestFileRoot(r, "root", FileRootDownloads, false)
+	rootDir := root.Path
+	path, err := safepath.Resolve(rootDir, r.GetString("path"))
+	if err != nil {
 		r.Response.WriteHeader(404)
 		r.Exit()
 	}
-	if !gfile.Exists(path) || gfile.IsDir(path) {
+	if !gfile.Exists(path) {
 		r.Response.WriteHeader(404)
 		r.Exit()
 	}
+	if gfile.IsDir(path) {
+		downloadDir(r, root, path)
+		return
+	}
 
-	r.Response.ServeFileDownload(path)
+	// 通过safepath打开文件，O_NONBLOCK避免打开管道文件时阻塞
+	// 以桌面用户的身份打开，打开之后的读取不受影响
+	var f *os.File
+	err = asDesktopUser(func() (e error) {
+		f, e = safepath.OpenFile(rootDir, safepath.Rel(rootDir, path), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		return e
+	})
+	if err != nil {
+		r.Response.WriteHeader(404)
+		r.Exit()
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		r.Response.WriteHeader(404)
+		r.Exit()
+	}
+	// ServeFileDownload内部使用http.ServeContent，会根据ETag和Last-Modified处理Range、If-Range和HEAD请求，
+	// 客户端可以先用HEAD获取文件大小，再断点续传
+	// 通过/proc/self/fd重新打开已经安全打开的文件，避免按路径打开时路径被替换成软链接
+	r.Response.Header().Set("ETag", fileETag(info))
+	r.Response.ServeFileDownload(fmt.Sprintf("/proc/self/fd/%d", f.Fd()), info.Name())
+}
+
+// 根据文件的修改时间和大小生成ETag，文件被修改后ETag随之变化，断点续传时If-Range不匹配会重新下载整个文件
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// 把目录打包后以流的方式下载
+func downloadDir(r *ghttp.Request, root *FileRoot, path string) {
+	format := r.GetString("format", ArchiveFormatZip)
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		r.Response.WriteHeader(400)
+		r.Exit()
+	}
+	name := gfile.Basename(path)
+	if path == root.Path {
+		name = root.Name
+	}
+	r.Response.Header().Set("Content-Type", contentType)
+	r.Response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment;filename="%s.%s"`, name, format))
+	// 先通过gf发送响应头，之后直接写入底层的ResponseWriter，避免gf结束时重复写入状态码
+	r.Response.WriteHeader(200)
+	r.Response.Flush()
+	writer := r.Response.Writer.RawWriter()
+	// 整个打包过程都以桌面用户的身份读取文件，期间当前goroutine独占一个系统线程
+	err := asDesktopUser(func() error {
+		return streamArchive(writer, format, root.Path, path)
+	})
+	if err != nil {
+		// 响应头已经发送，只能中断连接让客户端感知下载失败
+		logger.Warningf("打包下载目录[%s]失败:%v", path, err)
+		abortConnection(r)
+	}
+}
+
+// 中断已经开始发送响应体的连接，chunked的响应体没有正常结束，客户端会认为下载失败而不是得到一个损坏的文件
+// 不能使用panic(http.ErrAbortHandler)，gf会捕获panic并正常结束响应
+func abortConnection(r *ghttp.Request) {
+	if _, ok := r.Response.Writer.RawWriter().(http.Hijacker); !ok {
+		logger.Warningf("连接不支持Hijack，无法中断, path:%s", r.URL.Path)
+		r.ExitAll()
+	}
+	// 通过gf的Hijack接管连接，gf之后不会再向连接写入数据
+	conn, _, err := r.Response.Writer.Hijack()
+	if err != nil {
+		logger.Warningf("中断连接失败:%v", err)
+		r.ExitAll()
+	}
+	conn.Close()
+	r.ExitAll()
 }
@@ -1,11 +1,15 @@
 package app
 
 import (
+	"agent/pkg/safepath"
 	"fmt"
 	"github.com/gogf/gf/os/genv"
 	"github.com/gogf/gf/os/gfile"
 	"github.com/gogf/gf/test/gtest"
 	"github.com/gogf/gf/text/gstr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -32,3 +36,53 @@ func TestControllerApiV1_FileList(t *testing.T) {
 		}
 	})
 }
+
+func TestListDir(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		rootDir, err := ioutil.TempDir("", "filelist")
+		t.Assert(err, nil)
+		defer os.RemoveAll(rootDir)
+		rootDir, err = safepath.EvalRoot(rootDir)
+		t.Assert(err, nil)
+		t.Assert(os.MkdirAll(filepath.Join(rootDir, "dir", "sub"), 0755), nil)
+		t.Assert(ioutil.WriteFile(filepath.Join(rootDir, "b.txt"), []byte("bb"), 0644), nil)
+		t.Assert(ioutil.WriteFile(filepath.Join(rootDir, "a.png"), []byte("aaa"), 0644), nil)
+		t.Assert(ioutil.WriteFile(filepath.Join(rootDir, ".hidden"), []byte(""), 0644), nil)
+		t.Assert(os.Symlink("b.txt", filepath.Join(rootDir, "c-link")), nil)
+		t.Assert(os.Symlink("/etc/passwd", filepath.Join(rootDir, "d-out")), nil)
+
+		// 空目录返回空列表
+		total, list, err := listDir(rootDir, filepath.Join(rootDir, "dir", "sub"), &fileListOptions{Sort: FileSortName})
+		t.Assert(err, nil)
+		t.Assert(total, 0)
+		t.Assert(len(list), 0)
+
+		total, list, err = listDir(rootDir, rootDir, &fileListOptions{Sort: FileSortName})
+		t.Assert(err, nil)
+		t.Assert(total, 5)
+		t.Assert(list[0].Name, "dir")
+		t.Assert(list[0].ChildCount, 1)
+		t.Assert(list[0].Mime, "inode/directory")
+		t.Assert(list[1].Name, "a.png")
+		t.Assert(list[1].Mime, "image/png")
+		t.Assert(list[3].Name, "c-link")
+		t.Assert(list[3].LinkTarget, "b.txt")
+		t.Assert(list[3].Size, 2)
+		// 指向rootDir之外的软链接不展示目标文件的信息
+		t.Assert(list[4].Name, "d-out")
+		t.Assert(list[4].Mime, "inode/symlink")
+
+		total, list, err = listDir(rootDir, rootDir, &fileListOptions{Sort: FileSortSize, Desc: true, ShowHidden: true, Offset: 1, Limit: 2})
+		t.Assert(err, nil)
+		t.Assert(total, 6)
+		t.Assert(len(list), 2)
+		// 目录排在最前面，指向rootDir之外的软链接按链接本身的长度排序
+		t.Assert(list[0].Name, "d-out")
+		t.Assert(list[1].Name, "a.png")
+
+		total, list, err = listDir(rootDir, rootDir, &fileListOptions{Sort: FileSortName, Pattern: "*.txt"})
+		t.Assert(err, nil)
+		t.Assert(total, 1)
+		t.Assert(list[0].Name, "b.txt")
+	})
+}
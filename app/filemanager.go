@@ -0,0 +1,283 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/safepath"
+	"fmt"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/frame/g"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/os/gfile"
+	"github.com/osgochina/dmicro/logger"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 回收站目录，遵循freedesktop的回收站规范，桌面中的文件管理器可以直接看到和还原被删除的文件
+func trashDir() string {
+	return filepath.Join(env.Home(), ".local/share/Trash")
+}
+
+// 校验文件名，不允许包含路径分隔符
+func checkFileName(name string) error {
+	if len(name) <= 0 || name == "." || name == ".." || strings.ContainsRune(name, '/') || strings.ContainsRune(name, 0) {
+		return gerror.New("文件名不正确")
+	}
+	return nil
+}
+
+// 解析请求中的路径参数，路径不能是根目录本身，并且必须存在
+// 只解析父目录中的软链接，路径本身是软链接时操作的是链接本身，而不是链接指向的文件
+func resolveExistPath(rootDir string, path string) (string, error) {
+	abs, err := safepath.ResolveNoFollow(rootDir, path)
+	if err != nil {
+		return "", err
+	}
+	if abs == filepath.Clean(rootDir) {
+		return "", gerror.New("不能操作根目录")
+	}
+	if _, err = os.Lstat(abs); err != nil {
+		return "", gerror.New("path not found")
+	}
+	return abs, nil
+}
+
+// 解析目标目录参数，目标目录必须存在
+func resolveDestDir(rootDir string, dir string) (string, error) {
+	abs, err := safepath.Resolve(rootDir, dir)
+	if err != nil {
+		return "", err
+	}
+	if !gfile.IsDir(abs) {
+		return "", gerror.New("目标目录不存在")
+	}
+	return abs, nil
+}
+
+// 把srcRoot中的src移动到dstRoot中的dst，dst已存在时返回错误
+// 跨磁盘时无法rename，先复制再删除源文件
+func moveFile(srcRoot string, src string, dstRoot string, dst string) error {
+	from, to := safepath.Rel(srcRoot, src), safepath.Rel(dstRoot, dst)
+	err := safepath.Rename(srcRoot, from, dstRoot, to)
+	if err == nil {
+		return nil
+	}
+	if os.IsExist(err) {
+		return gerror.Newf("[%s]已存在", gfile.Basename(dst))
+	}
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	if err = copyTree(srcRoot, src, dstRoot, dst); err != nil {
+		return err
+	}
+	return safepath.RemoveAll(srcRoot, from)
+}
+
+// 递归复制文件或目录，复制失败时清理已经复制的内容，目标已存在时返回错误
+func copyTree(srcRoot string, src string, dstRoot string, dst string) error {
+	to := safepath.Rel(dstRoot, dst)
+	err := safepath.CopyAll(srcRoot, safepath.Rel(srcRoot, src), dstRoot, to)
+	if err == nil {
+		return nil
+	}
+	if os.IsExist(err) {
+		return gerror.Newf("[%s]已存在", gfile.Basename(dst))
+	}
+	_ = safepath.RemoveAll(dstRoot, to)
+	return err
+}
+
+// 统计复制需要的空间，软链接不占用空间
+func treeSize(path string) (int64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			return info.Size(), nil
+		}
+		return 0, nil
+	}
+	return dirSize(path)
+}
+
+// 检查目标目录所在磁盘是否还能容纳指定长度的内容
+func checkDiskSpace(dir string, size int64) error {
+	free, err := diskFree(existingDir(dir))
+	if err != nil {
+		return fmt.Errorf("获取磁盘空间失败,err:%v", err)
+	}
+	if size > free-env.UploadReservedSpace() {
+		return gerror.New("磁盘空间不足")
+	}
+	return nil
+}
+
+// 把rootDir中的文件移动到回收站，并写入.trashinfo记录原始路径和删除时间
+func moveToTrash(rootDir string, path string) error {
+	trashRoot, err := safepath.EvalRoot(trashDir())
+	if err != nil {
+		return fmt.Errorf("获取回收站目录失败,err:%v", err)
+	}
+	for _, dir := range []string{"files", "info"} {
+		if err = safepath.MkdirAll(trashRoot, dir, 0700); err != nil {
+			return fmt.Errorf("创建回收站目录失败,err:%v", err)
+		}
+	}
+	base := gfile.Basename(path)
+	ext := filepath.Ext(base)
+	name := base
+	for i := 1; ; i++ {
+		// 先独占创建.trashinfo文件，占住回收站中的文件名
+		infoName := "info/" + name + ".trashinfo"
+		info, err := safepath.OpenFile(trashRoot, infoName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			name = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), i, ext)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(info, "[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+			(&url.URL{Path: path}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+		if e := info.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = moveFile(rootDir, path, trashRoot, filepath.Join(trashRoot, "files", name))
+		}
+		if err != nil {
+			_ = safepath.RemoveAll(trashRoot, infoName)
+		}
+		return err
+	}
+}
+
+// Mkdir 创建目录，父目录不存在时一并创建
+func (that *ControllerApiV1) Mkdir(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootDownloads, true).Path
+	path, err := safepath.Resolve(rootDir, r.GetString("path"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	if gfile.Exists(path) {
+		FailJson(true, r, fmt.Sprintf("[%s]已存在", gfile.Basename(path)))
+	}
+	err = asDesktopUser(func() error {
+		return safepath.MkdirAll(rootDir, safepath.Rel(rootDir, path), 0755)
+	})
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	SusJson(true, r, "ok", g.Map{"path": safepath.Rel(rootDir, path)})
+}
+
+// Rename 重命名文件或目录，name只能是文件名，不能包含路径
+func (that *ControllerApiV1) Rename(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootDownloads, true).Path
+	path, err := resolveExistPath(rootDir, r.GetString("path"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	name := r.GetString("name")
+	if err = checkFileName(name); err != nil {
+		FailJson(true, r, err.Error())
+	}
+	target := filepath.Join(filepath.Dir(path), name)
+	if err = asDesktopUser(func() error { return moveFile(rootDir, path, rootDir, target) }); err != nil {
+		FailJson(true, r, err.Error())
+	}
+	SusJson(true, r, "ok", g.Map{"path": safepath.Rel(rootDir, target)})
+}
+
+// Move 把root中的文件或目录移动到toRoot的to目录中
+func (that *ControllerApiV1) Move(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootDownloads, true).Path
+	// toRoot为空时在同一个目录中操作
+	toRoot := requestFileRoot(r, "toRoot", r.GetString("root", FileRootDownloads), true)
+	path, err := resolveExistPath(rootDir, r.GetString("path"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	dir, err := resolveDestDir(toRoot.Path, r.GetString("to"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	// 目录不能移动到自己或者自己的子目录中
+	if safepath.Within(path, dir) {
+		FailJson(true, r, "不能移动到自身的子目录中")
+	}
+	target := filepath.Join(dir, gfile.Basename(path))
+	if err = asDesktopUser(func() error { return moveFile(rootDir, path, toRoot.Path, target) }); err != nil {
+		FailJson(true, r, err.Error())
+	}
+	SusJson(true, r, "ok", g.Map{"root": toRoot.Name, "path": safepath.Rel(toRoot.Path, target)})
+}
+
+// Copy 把root中的文件或目录复制到toRoot的to目录中，可以从只读目录中复制
+func (that *ControllerApiV1) Copy(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootDownloads, false).Path
+	// toRoot为空时在同一个目录中操作
+	toRoot := requestFileRoot(r, "toRoot", r.GetString("root", FileRootDownloads), true)
+	path, err := resolveExistPath(rootDir, r.GetString("path"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	dir, err := resolveDestDir(toRoot.Path, r.GetString("to"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	if safepath.Within(path, dir) {
+		FailJson(true, r, "不能复制到自身的子目录中")
+	}
+	target := filepath.Join(dir, gfile.Basename(path))
+	if _, err = os.Lstat(target); err == nil {
+		FailJson(true, r, fmt.Sprintf("[%s]已存在", gfile.Basename(target)))
+	}
+	size, err := treeSize(path)
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	if err = checkDiskSpace(dir, size); err != nil {
+		FailJson(true, r, err.Error())
+	}
+	err = asDesktopUser(func() error {
+		return copyTree(rootDir, path, toRoot.Path, target)
+	})
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	SusJson(true, r, "ok", g.Map{"root": toRoot.Name, "path": safepath.Rel(toRoot.Path, target)})
+}
+
+// Delete 删除文件或目录，默认移动到回收站，trash=false时直接删除
+func (that *ControllerApiV1) Delete(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootDownloads, true).Path
+	path, err := resolveExistPath(rootDir, r.GetString("path"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	trash := r.GetBool("trash", true)
+	err = asDesktopUser(func() error {
+		if trash {
+			return moveToTrash(rootDir, path)
+		}
+		return safepath.RemoveAll(rootDir, safepath.Rel(rootDir, path))
+	})
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	logger.Infof("删除文件：%s", path)
+	SusJson(true, r, "ok")
+}
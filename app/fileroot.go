@@ -0,0 +1,132 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/safepath"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/text/gstr"
+	"github.com/osgochina/dmicro/logger"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// 文件接口默认使用的目录
+const (
+	// FileRootDownloads 文件列表、下载和文件管理默认使用的目录
+	FileRootDownloads = "downloads"
+	// FileRootUploads 上传默认使用的目录
+	FileRootUploads = "uploads"
+)
+
+// 目录名称的格式
+var fileRootNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// FileRoot 文件接口可以访问的一个目录
+type FileRoot struct {
+	Name     string `json:"name"`
+	Path     string `json:"-"`
+	Writable bool   `json:"writable"`
+}
+
+// 解析目录配置，格式为 名称:路径[:r|rw]，多个用逗号分隔
+func parseFileRoots(config string, home string) ([]*FileRoot, error) {
+	var roots []*FileRoot
+	names := make(map[string]bool)
+	for _, item := range gstr.SplitAndTrim(config, ",") {
+		parts := gstr.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, gerror.Newf("目录配置[%s]格式错误", item)
+		}
+		root := &FileRoot{Name: parts[0], Path: parts[1], Writable: true}
+		if !fileRootNameRegex.MatchString(root.Name) {
+			return nil, gerror.Newf("目录名称[%s]格式错误", root.Name)
+		}
+		if names[root.Name] {
+			return nil, gerror.Newf("目录名称[%s]重复", root.Name)
+		}
+		names[root.Name] = true
+		if root.Path == "~" || strings.HasPrefix(root.Path, "~/") {
+			root.Path = home + root.Path[1:]
+		}
+		if !filepath.IsAbs(root.Path) {
+			return nil, gerror.Newf("目录[%s]必须是绝对路径", root.Name)
+		}
+		root.Path = filepath.Clean(root.Path)
+		if len(parts) == 3 {
+			switch parts[2] {
+			case "r":
+				root.Writable = false
+			case "rw":
+			default:
+				return nil, gerror.Newf("目录[%s]的读写权限[%s]错误", root.Name, parts[2])
+			}
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// 获取配置的所有目录
+func fileRoots() []*FileRoot {
+	roots, err := parseFileRoots(env.FileRoots(), env.Home())
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+	return roots
+}
+
+// 根据名称查找目录，name为空时使用默认目录，默认目录没有配置时使用第一个目录
+func findFileRoot(name string, defaultName string) (*FileRoot, error) {
+	roots := fileRoots()
+	if len(name) <= 0 {
+		name = defaultName
+		if len(roots) > 0 && findRootByName(roots, name) == nil {
+			return roots[0], nil
+		}
+	}
+	if root := findRootByName(roots, name); root != nil {
+		return root, nil
+	}
+	return nil, gerror.Newf("目录[%s]不存在", name)
+}
+
+func findRootByName(roots []*FileRoot, name string) *FileRoot {
+	for _, root := range roots {
+		if root.Name == name {
+			return root
+		}
+	}
+	return nil
+}
+
+// 获取请求中指定的目录，需要写入时目录必须可写，失败时直接返回错误信息
+// 返回的Path已经解析过软链接，可以直接作为safepath的root参数
+func requestFileRoot(r *ghttp.Request, key string, defaultName string, write bool) *FileRoot {
+	root, err := findFileRoot(r.GetString(key), defaultName)
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	// 目录本身是软链接时使用链接指向的真实目录，之后所有路径都在真实目录中校验
+	root.Path, err = safepath.EvalRoot(root.Path)
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	if write && !root.Writable {
+		logger.Warningf("拒绝写入只读目录[%s]", root.Name)
+		ForbiddenJson(true, r, "目录只读")
+	}
+	return root
+}
+
+// FileRoots 列出文件接口可以访问的目录
+func (that *ControllerApiV1) FileRoots(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	roots := fileRoots()
+	if roots == nil {
+		roots = []*FileRoot{}
+	}
+	SusJson(true, r, "ok", roots)
+}
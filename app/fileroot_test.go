@@ -0,0 +1,29 @@
+package app
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"testing"
+)
+
+func TestParseFileRoots(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		roots, err := parseFileRoots("home:~:rw, downloads:~/Downloads, shared-dataset:/mnt/course/:r", "/home/u")
+		t.Assert(err, nil)
+		t.Assert(len(roots), 3)
+		t.Assert(roots[0].Path, "/home/u")
+		t.Assert(roots[1].Path, "/home/u/Downloads")
+		t.Assert(roots[1].Writable, true)
+		t.Assert(roots[2].Name, "shared-dataset")
+		t.Assert(roots[2].Path, "/mnt/course")
+		t.Assert(roots[2].Writable, false)
+
+		_, err = parseFileRoots("a:relative/path", "/home/u")
+		t.AssertNE(err, nil)
+		_, err = parseFileRoots("a:/tmp,a:/var", "/home/u")
+		t.AssertNE(err, nil)
+		_, err = parseFileRoots("a:/tmp:x", "/home/u")
+		t.AssertNE(err, nil)
+		_, err = parseFileRoots("../a:/tmp", "/home/u")
+		t.AssertNE(err, nil)
+	})
+}
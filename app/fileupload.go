@@ -1,49 +1,161 @@
 package app
 
 import (
+	"agent/env"
+	"agent/pkg/safepath"
 	"bufio"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
-	"github.com/gogf/gf/crypto/gmd5"
+	"github.com/gogf/gf/frame/g"
 	"github.com/gogf/gf/net/ghttp"
-	"github.com/gogf/gf/os/genv"
 	"github.com/gogf/gf/os/gfile"
 	"github.com/gogf/gf/text/gstr"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"syscall"
 )
 
+// 一个文件最多的分片数量，避免客户端传入很大的totalChunks耗尽内存和cpu
+const uploadMaxChunks = 10000
+
+// 返回缺少的分片编号时最多返回的数量
+const uploadMaxMissingChunks = 100
+
+// 整个文件md5的格式，同时作为分片目录名，避免路径穿越
+var identifierRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// 分片文件存放的根目录，只允许agent自己访问
+func uploadTempDir() string {
+	return env.UploadTempDir()
+}
+
+// 某个文件的分片目录
+func uploadChunkDir(fileMd5 string) string {
+	return filepath.Join(uploadTempDir(), fileMd5)
+}
+
+// 分片文件的路径
+func chunkFilePath(fileMd5 string, chunkNumber int) string {
+	return filepath.Join(uploadChunkDir(fileMd5), strconv.Itoa(chunkNumber)+".part")
+}
+
+// 获取已经上传的分片编号，缺少的分片数量，以及最前面的uploadMaxMissingChunks个缺少的分片编号
+func uploadedChunks(fileMd5 string, totalChunks int) (uploaded []int, missingCount int, missing []int) {
+	uploaded = []int{}
+	missing = []int{}
+	for i := 1; i <= totalChunks; i++ {
+		if gfile.IsFile(chunkFilePath(fileMd5, i)) {
+			uploaded = append(uploaded, i)
+			continue
+		}
+		missingCount++
+		if len(missing) < uploadMaxMissingChunks {
+			missing = append(missing, i)
+		}
+	}
+	return uploaded, missingCount, missing
+}
+
+// 检查总的分片数量，不能超过uploadMaxChunks，传入了文件长度时也不能超过文件的字节数
+func checkTotalChunks(totalChunks int, totalSize int64) error {
+	if totalChunks > uploadMaxChunks {
+		return fmt.Errorf("分片数量不能超过%d", uploadMaxChunks)
+	}
+	if totalSize > 0 && int64(totalChunks) > totalSize {
+		return fmt.Errorf("分片数量不能超过文件长度")
+	}
+	return nil
+}
+
+// 确保目录存在，并且是当前用户所有、其他用户无法访问的真实目录
+// 防止其他用户提前创建同名目录或者软链接来窃取、篡改分片
+func ensurePrivateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("创建目录[%s]失败,err:%v", dir, err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("[%s]不是目录", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("目录[%s]的所有者不正确", dir)
+	}
+	if fi.Mode().Perm() != 0700 {
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
+
 // Upload 分片上传文件
+// GET请求用来查询已经上传的分片，前端跳过这些分片，实现断点续传
+// POST请求上传一个分片
 func (that *ControllerApiV1) Upload(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
 	// 接收，处理数据
-	fileName := r.GetString("fileName")              // 文件名
-	chunkNumber := r.GetInt("chunkNumber")           // 分片编号
-	currentChunkSize := r.GetInt("currentChunkSize") // 当前分片的长度
-	//totalChunks := r.GetInt("totalChunks")           // 总的分片数量
-	fileMd5 := r.GetString("identifier") // 整个文件的md5值
-	if chunkNumber == 0 || currentChunkSize == 0 || len(fileName) <= 0 || len(fileMd5) <= 0 {
+	fileName := r.GetString("fileName")                // 文件名
+	chunkNumber := r.GetInt("chunkNumber")             // 分片编号
+	currentChunkSize := r.GetInt("currentChunkSize")   // 当前分片的长度
+	totalChunks := r.GetInt("totalChunks")             // 总的分片数量
+	totalSize := r.GetInt64("totalSize")               // 整个文件的长度
+	fileMd5 := gstr.ToLower(r.GetString("identifier")) // 整个文件的md5值
+	root := requestFileRoot(r, "root", FileRootUploads, true)
+	if !identifierRegex.MatchString(fileMd5) {
+		FailJson(true, r, "identifier格式错误")
+	}
+	uploadGC.Touch(fileMd5)
+
+	// 上传文件前，需要做一次校验，使用get请求执行该操作
+	// 传入文件的基本信息，服务端返回已经上传的分片，以及是否可以合并
+	if r.Method == "GET" {
+		if totalChunks <= 0 || len(fileName) <= 0 || len(fileMd5) <= 0 {
+			FailJson(true, r, "参数有误")
+		}
+		if err := checkTotalChunks(totalChunks, totalSize); err != nil {
+			FailJson(true, r, err.Error())
+		}
+		if totalSize > 0 {
+			if err := checkUploadQuota(root.Path, totalSize); err != nil {
+				FailJson(true, r, err.Error())
+			}
+		}
+		uploaded, missingCount, _ := uploadedChunks(fileMd5, totalChunks)
+		SusJson(true, r, "ok", g.Map{
+			"uploaded": uploaded,
+			"merge":    missingCount == 0,
+		})
+	}
+	if chunkNumber <= 0 || currentChunkSize <= 0 || len(fileName) <= 0 || len(fileMd5) <= 0 {
 		FailJson(true, r, "参数有误")
 	}
-	// 临时的文件名
-	tempFileName := fileMd5 + "_" + strconv.Itoa(chunkNumber) + filepath.Ext(fileName)
-
-	//// 上传文件前，需要做一次校验，使用get请求执行该操作
-	//// 传入文件的基本信息，服务端根据条件返回不同的操作逻辑个前端
-	//if r.Method == "GET" {
-	//	// 如果文件长度等于单个分片长度，则告诉前端，可以合并该文件了
-	//	if chunkNumber == totalChunks {
-	//		resultInfo.IsUploaded = 0
-	//		resultInfo.Merge = 1
-	//		SusJson(true, r, "ok", resultInfo)
-	//	}
-	//
-	//	resultInfo.IsUploaded = 0
-	//	resultInfo.Merge = 0
-	//	SusJson(true, r, "ok", resultInfo)
-	//}
+	if totalChunks > 0 && chunkNumber > totalChunks {
+		FailJson(true, r, "分片编号超出总的分片数量")
+	}
+	if chunkNumber > uploadMaxChunks {
+		FailJson(true, r, fmt.Sprintf("分片编号不能超过%d", uploadMaxChunks))
+	}
+	if int64(currentChunkSize) > env.UploadMaxChunkSize() {
+		FailJson(true, r, fmt.Sprintf("分片长度不能超过%d字节", env.UploadMaxChunkSize()))
+	}
+	// 第一个分片检查配额，避免上传到一半才发现空间不足
+	if chunkNumber == 1 && totalSize > 0 {
+		if err := checkUploadQuota(root.Path, totalSize); err != nil {
+			FailJson(true, r, err.Error())
+		}
+	}
+	if err := checkChunkSpace(int64(currentChunkSize)); err != nil {
+		FailJson(true, r, err.Error())
+	}
 	// 保存当前分片
-	err := saveChunkToLocalFromMultiPartForm(r, "/tmp", tempFileName, currentChunkSize)
+	err := saveChunkToLocalFromMultiPartForm(r, fileMd5, chunkNumber, int64(currentChunkSize))
 	if err != nil {
 		FailJson(true, r, "上传失败", err.Error())
 	}
@@ -51,101 +163,210 @@ func (that *ControllerApiV1) Upload(r *ghttp.Request) {
 	return
 }
 
+// 合并时目标文件已存在的处理策略
+const (
+	// MergePolicyFail 目标文件已存在则合并失败
+	MergePolicyFail = "fail"
+	// MergePolicyOverwrite 覆盖已存在的目标文件
+	MergePolicyOverwrite = "overwrite"
+	// MergePolicyRename 自动重命名为 name(1).ext 的形式
+	MergePolicyRename = "rename"
+)
+
 // Merge 合并分片文件
+// 先合并到同目录下的临时文件，校验md5之后再移动到目标位置，合并失败会清理分片和临时文件
 func (that *ControllerApiV1) Merge(r *ghttp.Request) {
-	rootDir := fmt.Sprintf("%s/Uploads", genv.Get("HOME", "/home/vprix-user"))
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootUploads, true).Path
 	totalChunks := r.GetInt("totalChunks")
 	fileName := r.GetString("fileName")
-	fileMd5 := r.GetString("identifier")
-	if totalChunks == 0 || len(fileName) <= 0 || len(fileMd5) <= 0 {
+	fileMd5 := gstr.ToLower(r.GetString("identifier"))
+	policy := r.GetString("policy", MergePolicyFail)
+	if totalChunks <= 0 || len(fileName) <= 0 || len(fileMd5) <= 0 {
 		FailJson(true, r, "参数有误")
 	}
-	targetFileName := fmt.Sprintf("%s/%s", rootDir, fileName)
+	if err := checkTotalChunks(totalChunks, 0); err != nil {
+		FailJson(true, r, err.Error())
+	}
+	if !identifierRegex.MatchString(fileMd5) {
+		FailJson(true, r, "identifier格式错误")
+	}
+	// 合并期间不允许清理分片，也不允许同一个文件同时合并
+	if !uploadGC.BeginMerge(fileMd5) {
+		FailJson(true, r, "文件正在合并")
+	}
+	defer uploadGC.EndMerge(fileMd5)
+	if policy != MergePolicyFail && policy != MergePolicyOverwrite && policy != MergePolicyRename {
+		FailJson(true, r, "不支持的合并策略")
+	}
+	// 所有分片都上传完成才能合并，只返回最前面的一部分缺少的分片编号
+	if _, missingCount, missing := uploadedChunks(fileMd5, totalChunks); missingCount > 0 {
+		FailJson(true, r, "分片未全部上传", g.Map{"missingCount": missingCount, "missing": missing})
+	}
 	// 限制要上传的文件必须在uploads目录
-	if gstr.Pos(gfile.Abs(targetFileName), rootDir) != 0 {
+	targetFileName, err := safepath.Resolve(rootDir, fileName)
+	if err != nil || targetFileName == filepath.Clean(rootDir) {
 		FailJson(true, r, "path not found")
 	}
-	f, err := os.OpenFile(targetFileName, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0777)
+	if policy == MergePolicyFail && gfile.Exists(targetFileName) {
+		FailJson(true, r, fmt.Sprintf("文件[%s]已存在", fileName))
+	}
+	// 合并之前检查上传目录的配额和磁盘空间
+	chunksSize, err := dirSize(uploadChunkDir(fileMd5))
 	if err != nil {
-		FailJson(true, r, fmt.Sprintf("创建合并文件[%s]失败", targetFileName))
+		FailJson(true, r, err.Error())
 	}
-	var totalSize int64
-	writer := bufio.NewWriter(f)
-	for i := 1; i <= totalChunks; i++ {
-		currentChunkFile := "/tmp/" + fileMd5 + "_" + strconv.Itoa(i) + filepath.Ext(fileName) // 当前的分片名
-		bytes, err := ioutil.ReadFile(currentChunkFile)
-		if err != nil {
-			FailJson(true, r, fmt.Sprintf("读取分片文件[%s]失败，err:%s", currentChunkFile, err.Error()))
-		}
-		num, err := writer.Write(bytes)
-		if err != nil {
-			FailJson(true, r, fmt.Sprintf("写入分片文件[%s]失败，err:%s", currentChunkFile, err.Error()))
+	if err = checkUploadQuota(rootDir, chunksSize); err != nil {
+		FailJson(true, r, err.Error())
+	}
+	tempFileName, err := mergeChunks(rootDir, fileMd5, fileName, totalChunks, gfile.Dir(targetFileName))
+	// 无论合并成功还是md5校验失败，分片都已经没有用处，需要全部清理
+	removeChunks(fileMd5)
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	err = asDesktopUser(func() (e error) {
+		targetFileName, e = commitMergedFile(tempFileName, targetFileName, policy)
+		return e
+	})
+	if err != nil {
+		_ = os.Remove(tempFileName)
+		FailJson(true, r, err.Error())
+	}
+	SusJson(true, r, "ok", g.Map{"path": safepath.Rel(rootDir, targetFileName)})
+}
+
+// 把分片合并到目标目录下的临时文件中，同时计算md5，md5与identifier不一致时删除临时文件
+func mergeChunks(rootDir string, fileMd5 string, fileName string, totalChunks int, dir string) (string, error) {
+	// 目录和合并文件以桌面用户的身份创建，分片在agent的私有目录中，仍然以agent的身份读取
+	var f *os.File
+	err := asDesktopUser(func() (e error) {
+		if e = safepath.MkdirAll(rootDir, safepath.Rel(rootDir, dir), 0755); e != nil {
+			return fmt.Errorf("创建目录[%s]失败,err:%v", dir, e)
 		}
-		totalSize += int64(num)
-		err = os.Remove(currentChunkFile)
-		if err != nil {
-			FailJson(true, r, "合并分片失败", err.Error())
+		f, e = ioutil.TempFile(dir, "."+gfile.Basename(fileName)+".*.uploading")
+		if e != nil {
+			return fmt.Errorf("创建合并文件失败,err:%v", e)
 		}
-	}
-	err = writer.Flush()
+		return nil
+	})
 	if err != nil {
-		FailJson(true, r, fmt.Sprintf("写入全部分片失败,%s", err.Error()))
+		return "", err
 	}
-	// 在重新打开文件之间关闭
+	tempFileName := f.Name()
+	hash := md5.New()
+	writer := bufio.NewWriter(io.MultiWriter(f, hash))
+	err = func() error {
+		for i := 1; i <= totalChunks; i++ {
+			currentChunkFile := chunkFilePath(fileMd5, i) // 当前的分片名
+			chunk, e := os.Open(currentChunkFile)
+			if e != nil {
+				return fmt.Errorf("读取分片文件[%d]失败，err:%s", i, e.Error())
+			}
+			_, e = io.Copy(writer, chunk)
+			_ = chunk.Close()
+			if e != nil {
+				return fmt.Errorf("写入分片文件[%d]失败，err:%s", i, e.Error())
+			}
+		}
+		if e := writer.Flush(); e != nil {
+			return fmt.Errorf("写入全部分片失败,%s", e.Error())
+		}
+		return f.Chmod(0644)
+	}()
 	_ = f.Close()
-	// 计算已合并文件的md5
-	md5Str, err := gmd5.EncryptFile(targetFileName)
 	if err != nil {
-		FailJson(true, r, fmt.Sprintf("计算已合并文件的md5[%s]失败，err:%s", targetFileName, err))
+		_ = os.Remove(tempFileName)
+		return "", err
 	}
-	if fileMd5 != md5Str {
-		//_ = gfile.Remove(targetFileName)
-		//FailJson(true, r, "md5对比失败")
+	// 校验已合并文件的md5
+	if md5Str := hex.EncodeToString(hash.Sum(nil)); md5Str != fileMd5 {
+		_ = os.Remove(tempFileName)
+		return "", fmt.Errorf("md5校验失败，期望[%s]，实际[%s]", fileMd5, md5Str)
 	}
-	SusJson(true, r, "ok")
+	return tempFileName, nil
 }
 
-// 保存文件分片
-func saveChunkToLocalFromMultiPartForm(r *ghttp.Request, tempDir, tempFileName string, currentChunkSize int) (err error) {
-	if !gfile.IsDir(tempDir) {
-		err = gfile.Mkdir(tempDir)
-		if err != nil {
-			return fmt.Errorf("创建临时文件 %s 失败,err:%v", tempDir, err)
+// 按照策略把临时文件移动到目标位置，返回最终的文件路径
+// 不覆盖的情况下使用硬链接，保证目标文件已存在时不会被覆盖
+func commitMergedFile(tempFileName string, targetFileName string, policy string) (string, error) {
+	if policy == MergePolicyOverwrite {
+		if err := os.Rename(tempFileName, targetFileName); err != nil {
+			return "", fmt.Errorf("保存文件失败,err:%v", err)
 		}
-		err = gfile.Chmod(tempDir, 0766)
-		if err != nil {
-			return err
+		return targetFileName, nil
+	}
+	ext := filepath.Ext(targetFileName)
+	base := gstr.TrimRightStr(targetFileName, ext)
+	candidate := targetFileName
+	for i := 1; ; i++ {
+		err := os.Link(tempFileName, candidate)
+		if err == nil {
+			_ = os.Remove(tempFileName)
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("保存文件失败,err:%v", err)
 		}
+		if policy != MergePolicyRename {
+			return "", fmt.Errorf("文件[%s]已存在", gfile.Basename(targetFileName))
+		}
+		candidate = fmt.Sprintf("%s(%d)%s", base, i, ext)
 	}
-	fileHeader := r.Request.MultipartForm.File["file"][0]
-	if fileHeader == nil {
+}
+
+// 删除全部分片
+func removeChunks(fileMd5 string) {
+	_ = os.RemoveAll(uploadChunkDir(fileMd5))
+}
+
+// 保存文件分片
+// 以流的方式写入分片目录下的临时文件，长度与声明的一致后再重命名为正式的分片文件
+func saveChunkToLocalFromMultiPartForm(r *ghttp.Request, fileMd5 string, chunkNumber int, currentChunkSize int64) (err error) {
+	if err = ensurePrivateDir(uploadTempDir()); err != nil {
+		return err
+	}
+	if err = ensurePrivateDir(uploadChunkDir(fileMd5)); err != nil {
+		return err
+	}
+	fileHeaders := r.GetMultipartFiles("file")
+	if len(fileHeaders) == 0 || fileHeaders[0] == nil {
 		return fmt.Errorf("fileHeader 为空")
 	}
-	file, err := fileHeader.Open()
+	if fileHeaders[0].Size > currentChunkSize {
+		return fmt.Errorf("接收的文件长度[%d]与传入的长度[%d]不一致", fileHeaders[0].Size, currentChunkSize)
+	}
+	file, err := fileHeaders[0].Open()
 	if err != nil {
 		return fmt.Errorf("error : %v", err)
 	}
+	defer file.Close()
 	// 创建临时文件
-	myFile, err := gfile.Create(fmt.Sprintf("%s/%s", tempDir, tempFileName))
+	chunkFile := chunkFilePath(fileMd5, chunkNumber)
+	tempFile, err := ioutil.TempFile(uploadChunkDir(fileMd5), strconv.Itoa(chunkNumber)+".*.tmp")
 	if err != nil {
 		return fmt.Errorf("error : %v", err)
 	}
-	// 读取从客户端传过来的文件内容
-	buf := make([]byte, currentChunkSize)
-	num, err := file.Read(buf)
+	defer func() {
+		_ = tempFile.Close()
+		if err != nil {
+			_ = os.Remove(tempFile.Name())
+		}
+	}()
+	// 最多多读一个字节，用来判断客户端传入的内容是否超过了声明的长度
+	num, err := io.Copy(tempFile, io.LimitReader(file, currentChunkSize+1))
 	if err != nil {
 		return fmt.Errorf("error : %v", err)
 	}
 	if num != currentChunkSize {
-		return fmt.Errorf("接收的文件长度[%d]与传入的长度[%d]不一致", num, currentChunkSize)
+		err = fmt.Errorf("接收的文件长度[%d]与传入的长度[%d]不一致", num, currentChunkSize)
+		return err
 	}
-	num, err = myFile.Write(buf)
-	if err != nil {
+	if err = tempFile.Close(); err != nil {
+		return fmt.Errorf("error : %v", err)
+	}
+	if err = os.Rename(tempFile.Name(), chunkFile); err != nil {
 		return fmt.Errorf("error : %v", err)
 	}
-	// 关闭文件
-	_ = myFile.Close()
-	_ = file.Close()
-
 	return nil
 }
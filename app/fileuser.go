@@ -0,0 +1,17 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/fsuser"
+	"fmt"
+)
+
+// 以桌面用户的身份执行文件操作，创建的文件属于桌面用户，并且遵守桌面用户的文件权限
+// 与在桌面中保存文件得到的所有者和权限一致
+func asDesktopUser(fn func() error) error {
+	cred, err := fsuser.Lookup(env.User())
+	if err != nil {
+		return fmt.Errorf("获取桌面用户[%s]失败,err:%v", env.User(), err)
+	}
+	return cred.Do(fn)
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"agent/env"
+	"github.com/osgochina/dmicro/logger"
+	"sync"
+	"time"
+)
+
+// 最多保存的登录失败记录数，超过后淘汰最久没有失败的记录，避免大量ip或用户名耗尽内存
+const loginGuardCapacity = 10000
+
+// 登录失败的记录
+type loginFailure struct {
+	// 连续失败的次数
+	count int
+	// 当前的拒绝时长，每次在拒绝期后再失败都会翻倍
+	timeout time.Duration
+	// 拒绝登录的截止时间
+	blockUntil time.Time
+	// 最后一次失败的时间
+	lastFail time.Time
+}
+
+// loginGuard 按ip和用户名统计登录失败次数，超过阈值后临时拒绝登录，参考xvnc的BlacklistThreshold/BlacklistTimeout
+type loginGuard struct {
+	mu         sync.Mutex
+	enabled    bool
+	threshold  int
+	timeout    time.Duration
+	maxTimeout time.Duration
+	capacity   int
+	failures   map[string]*loginFailure
+}
+
+var loginGuards = newLoginGuard(
+	env.LoginUseBlacklist(),
+	env.LoginBlacklistThreshold(),
+	time.Duration(env.LoginBlacklistTimeout())*time.Second,
+	time.Duration(env.LoginBlacklistMaxTimeout())*time.Second,
+)
+
+func newLoginGuard(enabled bool, threshold int, timeout time.Duration, maxTimeout time.Duration) *loginGuard {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	if maxTimeout < timeout {
+		maxTimeout = timeout
+	}
+	return &loginGuard{
+		enabled:    enabled,
+		threshold:  threshold,
+		timeout:    timeout,
+		maxTimeout: maxTimeout,
+		capacity:   loginGuardCapacity,
+		failures:   make(map[string]*loginFailure),
+	}
+}
+
+// 生成统计的key
+func loginGuardKeys(ip string, username string) []string {
+	keys := []string{"ip:" + ip}
+	if len(username) > 0 {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+// Blocked 判断是否被拒绝登录，返回剩余的拒绝时长
+func (that *loginGuard) Blocked(ip string, username string) time.Duration {
+	if !that.enabled {
+		return 0
+	}
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	now := time.Now()
+	var remain time.Duration
+	for _, key := range loginGuardKeys(ip, username) {
+		f, ok := that.failures[key]
+		if !ok {
+			continue
+		}
+		if d := f.blockUntil.Sub(now); d > remain {
+			remain = d
+		}
+	}
+	return remain
+}
+
+// Fail 记录一次登录失败
+func (that *loginGuard) Fail(ip string, username string) {
+	if !that.enabled {
+		return
+	}
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	now := time.Now()
+	that.prune(now)
+	for _, key := range loginGuardKeys(ip, username) {
+		f, ok := that.failures[key]
+		if !ok {
+			if len(that.failures) >= that.capacity {
+				that.evict(now)
+			}
+			f = &loginFailure{}
+			that.failures[key] = f
+		}
+		f.count++
+		f.lastFail = now
+		if f.count < that.threshold {
+			continue
+		}
+		if f.timeout <= 0 {
+			f.timeout = that.timeout
+		} else {
+			f.timeout *= 2
+			if f.timeout > that.maxTimeout {
+				f.timeout = that.maxTimeout
+			}
+		}
+		f.blockUntil = now.Add(f.timeout)
+		logger.Warningf("登录失败次数过多，临时拒绝登录: %s, 失败次数:%d, 拒绝时长:%s", key, f.count, f.timeout)
+	}
+}
+
+// Success 登录成功后清除失败记录
+func (that *loginGuard) Success(ip string, username string) {
+	if !that.enabled {
+		return
+	}
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	for _, key := range loginGuardKeys(ip, username) {
+		delete(that.failures, key)
+	}
+}
+
+// 清理已经过了拒绝期并且长时间没有再失败的记录
+func (that *loginGuard) prune(now time.Time) {
+	for key, f := range that.failures {
+		if now.After(f.blockUntil) && now.Sub(f.lastFail) > that.maxTimeout {
+			delete(that.failures, key)
+		}
+	}
+}
+
+// 淘汰一条记录，优先淘汰不在拒绝期内并且最久没有失败的记录
+func (that *loginGuard) evict(now time.Time) {
+	var oldestKey string
+	var oldest *loginFailure
+	for key, f := range that.failures {
+		blocked := now.Before(f.blockUntil)
+		if oldest != nil {
+			oldestBlocked := now.Before(oldest.blockUntil)
+			if blocked && !oldestBlocked {
+				continue
+			}
+			if blocked == oldestBlocked && !f.lastFail.Before(oldest.lastFail) {
+				continue
+			}
+		}
+		oldestKey, oldest = key, f
+	}
+	if oldest != nil {
+		delete(that.failures, oldestKey)
+	}
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"fmt"
+	"github.com/gogf/gf/test/gtest"
+	"testing"
+	"time"
+)
+
+func TestLoginGuard(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		g := newLoginGuard(true, 3, time.Second, 4*time.Second)
+		for i := 0; i < 2; i++ {
+			g.Fail("127.0.0.1", "vprix")
+		}
+		t.Assert(g.Blocked("127.0.0.1", "vprix") == 0, true)
+		g.Fail("127.0.0.1", "vprix")
+		t.Assert(g.Blocked("127.0.0.1", "vprix") > 0, true)
+		// 换ip同一个用户名，或者同ip换用户名都会被拒绝
+		t.Assert(g.Blocked("127.0.0.2", "vprix") > 0, true)
+		t.Assert(g.Blocked("127.0.0.1", "other") > 0, true)
+		t.Assert(g.Blocked("127.0.0.2", "other") == 0, true)
+
+		// 拒绝时长翻倍，但是不超过最大值
+		g.Fail("127.0.0.1", "vprix")
+		t.Assert(g.Blocked("127.0.0.1", "vprix") > time.Second, true)
+		g.Fail("127.0.0.1", "vprix")
+		g.Fail("127.0.0.1", "vprix")
+		t.Assert(g.Blocked("127.0.0.1", "vprix") <= 4*time.Second, true)
+
+		g.Success("127.0.0.1", "vprix")
+		t.Assert(g.Blocked("127.0.0.1", "vprix") == 0, true)
+
+		// 记录数不超过上限，淘汰时保留拒绝期内的记录
+		limited := newLoginGuard(true, 3, time.Minute, time.Minute)
+		limited.capacity = 4
+		for i := 0; i < 3; i++ {
+			limited.Fail("10.0.0.1", "vprix")
+		}
+		for i := 0; i < 100; i++ {
+			limited.Fail(fmt.Sprintf("10.1.0.%d", i), "")
+			t.Assert(len(limited.failures) <= 4, true)
+		}
+		t.Assert(limited.Blocked("10.0.0.1", "") > 0, true)
+		t.Assert(limited.Blocked("10.0.0.2", "vprix") > 0, true)
+
+		disabled := newLoginGuard(false, 1, time.Second, time.Second)
+		disabled.Fail("127.0.0.1", "vprix")
+		t.Assert(disabled.Blocked("127.0.0.1", "vprix") == 0, true)
+	})
+}
@@ -0,0 +1,303 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/customexec"
+	"agent/pkg/desktop"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/osgochina/dmicro/logger"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 每次写入麦克风管道的声音时长
+const micFrameDuration = 20 * time.Millisecond
+
+// 每毫秒的pcm数据长度，s16le每个采样2字节
+const micBytesPerMs = desktop.MicSampleRate * desktop.MicChannels * 2 / 1000
+
+// 每次写入麦克风管道的数据长度
+const micFrameSize = micBytesPerMs * int(micFrameDuration/time.Millisecond)
+
+// 单个websocket消息的最大长度
+const micMaxMessageSize = 64 * 1024
+
+// jitterBuffer 缓存一个会话中浏览器发来的声音，吸收网络抖动
+// 缓存到prebuffer之后才开始输出，缓存不足时暂停输出重新缓存，超过max时丢弃最早的声音避免延迟越来越大
+type jitterBuffer struct {
+	mu        sync.Mutex
+	data      []byte
+	prebuffer int
+	max       int
+	playing   bool
+	muted     bool
+}
+
+func newJitterBuffer(prebufferMs int, maxMs int) *jitterBuffer {
+	if maxMs < prebufferMs {
+		maxMs = prebufferMs
+	}
+	return &jitterBuffer{
+		prebuffer: prebufferMs * micBytesPerMs,
+		max:       maxMs * micBytesPerMs,
+	}
+}
+
+// Write 写入pcm数据，长度必须是完整的采样
+func (that *jitterBuffer) Write(p []byte) {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	that.data = append(that.data, p...)
+	if over := len(that.data) - that.max; over > 0 {
+		over += over % 2
+		that.data = append(that.data[:0], that.data[over:]...)
+	}
+}
+
+// Read 读取一帧声音，没有可以输出的声音时返回false，静音时照常消耗缓存但是返回false
+func (that *jitterBuffer) Read(frame []byte) bool {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	if !that.playing {
+		if len(that.data) < that.prebuffer || len(that.data) < len(frame) {
+			return false
+		}
+		that.playing = true
+	}
+	if len(that.data) < len(frame) {
+		that.playing = false
+		return false
+	}
+	copy(frame, that.data)
+	that.data = append(that.data[:0], that.data[len(frame):]...)
+	return !that.muted
+}
+
+// SetMuted 设置是否静音
+func (that *jitterBuffer) SetMuted(muted bool) {
+	that.mu.Lock()
+	that.muted = muted
+	that.mu.Unlock()
+}
+
+// 把一帧s16le的声音叠加到mix中
+func mixFrame(mix []int32, frame []byte) {
+	for i := range mix {
+		mix[i] += int32(int16(binary.LittleEndian.Uint16(frame[i*2:])))
+	}
+}
+
+// 把叠加之后的声音转换为s16le，超出范围的采样截断
+func encodeMix(mix []int32, out []byte) {
+	for i, v := range mix {
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(int16(v)))
+	}
+}
+
+// micMixer 把所有会话的声音混合之后按照实时的速度写入麦克风管道，没有会话时停止写入
+type micMixer struct {
+	mu       sync.Mutex
+	sessions map[*jitterBuffer]struct{}
+	stop     chan struct{}
+}
+
+var microphone = &micMixer{sessions: make(map[*jitterBuffer]struct{})}
+
+// Add 添加一个会话
+func (that *micMixer) Add(buf *jitterBuffer) {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	that.sessions[buf] = struct{}{}
+	if that.stop == nil {
+		that.stop = make(chan struct{})
+		go that.run(that.stop)
+	}
+}
+
+// Remove 移除一个会话
+func (that *micMixer) Remove(buf *jitterBuffer) {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	delete(that.sessions, buf)
+	if len(that.sessions) == 0 && that.stop != nil {
+		close(that.stop)
+		that.stop = nil
+	}
+}
+
+// 混合所有会话的一帧声音，没有任何会话输出声音时返回false
+func (that *micMixer) mix(out []byte) bool {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	frame := make([]byte, len(out))
+	mix := make([]int32, len(out)/2)
+	active := false
+	for buf := range that.sessions {
+		if buf.Read(frame) {
+			mixFrame(mix, frame)
+			active = true
+		}
+	}
+	encodeMix(mix, out)
+	return active
+}
+
+func (that *micMixer) run(stop chan struct{}) {
+	ticker := time.NewTicker(micFrameDuration)
+	defer ticker.Stop()
+	var pipe *os.File
+	defer func() {
+		if pipe != nil {
+			_ = pipe.Close()
+		}
+	}()
+	out := make([]byte, micFrameSize)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		active := that.mix(out)
+		if pipe == nil {
+			var err error
+			// 非阻塞打开，声音服务没有运行时直接失败，下一帧重试
+			pipe, err = os.OpenFile(pulseAudio.MicPipe(), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+			if err != nil {
+				pipe = nil
+				continue
+			}
+		}
+		// 没有会话输出声音时也写入静音，保持声音服务读取的节奏
+		if _, err := pipe.Write(out); err != nil && err != syscall.EAGAIN {
+			if active {
+				logger.Debugf("写入麦克风失败:%v", err)
+			}
+			_ = pipe.Close()
+			pipe = nil
+		}
+	}
+}
+
+// micControl 客户端发送的控制消息
+type micControl struct {
+	Mute *bool `json:"mute"`
+}
+
+// 麦克风的输入通道
+// codec指定编码格式，pcm(默认)或opus；pcm格式为48000Hz单声道s16le，opus格式时container指定浏览器录制的封装格式，webm(默认)或ogg
+// 二进制消息为声音数据，文本消息为控制消息，{"mute":true}静音，{"mute":false}取消静音
+func micWebSocket(r *ghttp.Request) {
+	visitor := currentVisitor(r)
+	if visitor == nil || !visitor.Role.Can(PermInput) {
+		r.Response.WriteStatusExit(http.StatusForbidden)
+		return
+	}
+	if pulseAudio == nil {
+		r.Response.WriteStatusExit(http.StatusServiceUnavailable)
+		return
+	}
+	codec := r.GetString("codec", desktop.AudioCodecPCM)
+	var decoder *customexec.Cmd
+	switch codec {
+	case desktop.AudioCodecPCM:
+	case desktop.AudioCodecOpus:
+		var err error
+		decoder, err = pulseAudio.DecodeCommand(r.GetString("container", desktop.AudioContainerWebm))
+		if err != nil {
+			r.Response.WriteStatusExit(http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		r.Response.WriteStatusExit(http.StatusBadRequest, "不支持的编码格式")
+		return
+	}
+	serveWebSocket(r, func(ws *websocket.Conn) {
+		defer ws.Close()
+		ws.MaxPayloadBytes = micMaxMessageSize
+		buf := newJitterBuffer(env.MicJitterBuffer(), env.MicMaxLatency())
+		write := buf.Write
+		if decoder != nil {
+			stdin, err := startMicDecoder(decoder, buf)
+			if err != nil {
+				logger.Warningf("启动麦克风解码失败:%v", err)
+				return
+			}
+			defer func() {
+				_ = stdin.Close()
+				_ = decoder.Process.Kill()
+				_ = decoder.Wait()
+			}()
+			write = func(p []byte) {
+				_, _ = stdin.Write(p)
+			}
+		}
+		microphone.Add(buf)
+		defer microphone.Remove(buf)
+		logger.Infof("开始接收麦克风, username:%s, codec:%s", visitor.Username, codec)
+		defer logger.Infof("停止接收麦克风, username:%s", visitor.Username)
+		for {
+			msg := new(wsMessage)
+			if err := wsMessageCodec.Receive(ws, msg); err != nil {
+				return
+			}
+			if !msg.binary {
+				ctrl := new(micControl)
+				if err := json.Unmarshal(msg.data, ctrl); err != nil {
+					logger.Debugf("麦克风控制消息格式错误:%v", err)
+					continue
+				}
+				if ctrl.Mute != nil {
+					buf.SetMuted(*ctrl.Mute)
+				}
+				continue
+			}
+			// pcm格式必须是完整的采样
+			if decoder == nil && len(msg.data)%2 != 0 {
+				continue
+			}
+			write(msg.data)
+		}
+	})
+}
+
+// 启动解码进程，把解码之后的pcm写入buf，返回写入待解码数据的管道
+func startMicDecoder(cmd *customexec.Cmd, buf *jitterBuffer) (io.WriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		// 保证每次写入的都是完整的采样
+		data := make([]byte, micFrameSize)
+		for {
+			n, err := io.ReadFull(stdout, data)
+			if n > 0 {
+				buf.Write(data[:n-n%2])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return stdin, nil
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"encoding/binary"
+	"github.com/gogf/gf/test/gtest"
+	"testing"
+)
+
+func TestJitterBuffer(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		// 缓存20ms之后开始输出，最多缓存40ms
+		buf := newJitterBuffer(20, 40)
+		frame := make([]byte, 10*micBytesPerMs)
+
+		buf.Write(make([]byte, 10*micBytesPerMs))
+		t.Assert(buf.Read(frame), false)
+		buf.Write(make([]byte, 10*micBytesPerMs))
+		t.Assert(buf.Read(frame), true)
+		t.Assert(buf.Read(frame), true)
+		// 缓存用完之后重新缓存
+		t.Assert(buf.Read(frame), false)
+		buf.Write(make([]byte, 10*micBytesPerMs))
+		t.Assert(buf.Read(frame), false)
+
+		// 超过最大缓存时丢弃最早的声音
+		data := make([]byte, 60*micBytesPerMs)
+		data[len(data)-40*micBytesPerMs] = 1
+		buf.Write(data)
+		t.Assert(len(buf.data), 40*micBytesPerMs)
+		t.Assert(buf.Read(frame), true)
+		t.Assert(frame[0], 1)
+
+		// 静音时照常消耗缓存
+		buf.SetMuted(true)
+		t.Assert(buf.Read(frame), false)
+		t.Assert(len(buf.data), 20*micBytesPerMs)
+	})
+}
+
+func TestMixFrame(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		frame := func(samples ...int16) []byte {
+			b := make([]byte, len(samples)*2)
+			for i, s := range samples {
+				binary.LittleEndian.PutUint16(b[i*2:], uint16(s))
+			}
+			return b
+		}
+		mix := make([]int32, 3)
+		mixFrame(mix, frame(100, 30000, -30000))
+		mixFrame(mix, frame(-50, 30000, -30000))
+		out := make([]byte, 6)
+		encodeMix(mix, out)
+		t.Assert(out, frame(50, 32767, -32768))
+	})
+}
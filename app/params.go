@@ -21,9 +21,11 @@ type VncConnParams struct {
 // ShareConnParams 分享链接的参数
 type ShareConnParams struct {
 	RW             string      `json:"rw"`
+	Role           string      `json:"role"`
 	Uid            int         `json:"uid"`
 	Nickname       string      `json:"nickname"`
 	Token          string      `json:"token"`
+	ShareToken     string      `json:"share_token"`
 	ComputerId     int         `json:"computer_id"`
 	ShareTime      *gtime.Time `json:"share_time"`
 	ExpirationTime *gtime.Time `json:"expiration_time"`
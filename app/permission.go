@@ -0,0 +1,107 @@
+package app
+
+import (
+	"agent/pkg/auth"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/osgochina/dmicro/logger"
+)
+
+// Role 访问桌面的角色
+type Role string
+
+const (
+	// RoleOwner 桌面的所有者，拥有全部权限
+	RoleOwner Role = "owner"
+	// RoleCollaborator 协作者，可以操作桌面和同步剪贴板，但是不能传输文件
+	RoleCollaborator Role = "collaborator"
+	// RoleViewer 观看者，只能查看桌面
+	RoleViewer Role = "viewer"
+)
+
+// Permission 权限
+type Permission string
+
+const (
+	// PermView 查看桌面
+	PermView Permission = "view"
+	// PermInput 通过键盘鼠标操作桌面
+	PermInput Permission = "input"
+	// PermFileTransfer 浏览、上传、下载文件
+	PermFileTransfer Permission = "file_transfer"
+	// PermShare 创建和管理分享链接
+	PermShare Permission = "share"
+	// PermControl 控制类接口
+	PermControl Permission = "control"
+	// PermClipboard 读写桌面的剪贴板
+	PermClipboard Permission = "clipboard"
+	// PermExec 在桌面中执行命令和使用网页终端
+	PermExec Permission = "exec"
+)
+
+// 每个角色拥有的权限
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:        {PermView, PermInput, PermFileTransfer, PermShare, PermControl, PermClipboard, PermExec},
+	RoleCollaborator: {PermView, PermInput, PermClipboard},
+	RoleViewer:       {PermView},
+}
+
+// ParseRole 解析角色名称
+func ParseRole(name string) (Role, bool) {
+	role := Role(name)
+	_, ok := rolePermissions[role]
+	return role, ok
+}
+
+// roleFromRW 兼容旧的分享读写模式
+func roleFromRW(rw string) Role {
+	if rw == ShareModeReadWrite {
+		return RoleCollaborator
+	}
+	return RoleViewer
+}
+
+// Can 判断角色是否拥有权限
+func (that Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[that] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RW 角色对应的读写模式，前端根据该值决定是否显示为只读
+func (that Role) RW() string {
+	if that.Can(PermInput) {
+		return ShareModeReadWrite
+	}
+	return ShareModeRead
+}
+
+// Visitor 当前请求的访问者
+type Visitor struct {
+	*auth.Identity
+	Role Role
+	// 通过分享链接访问时的分享信息
+	Share *ShareConnParams
+}
+
+// 获取中间件中保存的访问者
+func currentVisitor(r *ghttp.Request) *Visitor {
+	visitor, _ := r.GetCtxVar(ctxKeyVisitor).Val().(*Visitor)
+	return visitor
+}
+
+// requirePermission 校验当前访问者的权限，没有权限时直接返回
+func requirePermission(r *ghttp.Request, perm Permission) {
+	visitor := currentVisitor(r)
+	if visitor == nil {
+		UnauthenticatedJson(true, r, "请登录")
+		return
+	}
+	if !visitor.Role.Can(perm) {
+		logger.Warningf("没有权限, ip:%s, username:%s, role:%s, permission:%s",
+			r.GetClientIp(), visitor.Username, visitor.Role, perm)
+		ForbiddenJson(true, r, "没有权限")
+	}
+}
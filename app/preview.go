@@ -0,0 +1,324 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/safepath"
+	"bytes"
+	"fmt"
+	"github.com/gogf/gf/encoding/gcharset"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/os/gcache"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// 文本预览默认读取的长度，单位KB
+const defaultPreviewTextKB = 64
+
+// 缩略图默认和最大的边长
+const (
+	defaultThumbnailSize = 256
+	maxThumbnailSize     = 1024
+)
+
+// 可以生成缩略图的图片类型
+var thumbnailMimes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// 缩略图缓存，最多缓存256张，文件修改之后缓存的key随之变化
+var thumbnailCache = gcache.New(256)
+
+// 缩略图缓存的有效期
+const thumbnailCacheExpire = time.Hour
+
+// thumbnail 生成的缩略图
+type thumbnail struct {
+	contentType string
+	data        []byte
+}
+
+// TextPreview 文本预览的结果
+type TextPreview struct {
+	// 检测到的原始编码，content已经转换为UTF-8
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+	// 文件是否只读取了一部分
+	Truncated bool  `json:"truncated"`
+	Size      int64 `json:"size"`
+}
+
+// 不可见的控制字符是否过多，过多时认为是二进制文件
+func tooManyControlChars(data []byte) bool {
+	count := 0
+	for _, c := range data {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' && c != '\v' && c != 0x1b {
+			count++
+		}
+	}
+	return count*10 > len(data)
+}
+
+// 去掉末尾被截断的不完整的UTF-8字符
+func trimIncompleteUTF8(data []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// 按照编码转换为UTF-8，转换之后出现替换字符说明不是这种编码，truncated时忽略末尾被截断的字符
+func decodeText(charset string, data []byte, truncated bool) (string, bool) {
+	text, err := gcharset.ToUTF8(charset, string(data))
+	if err != nil {
+		return "", false
+	}
+	if truncated {
+		text = strings.TrimRight(text, string(utf8.RuneError))
+	}
+	if strings.ContainsRune(text, utf8.RuneError) {
+		return "", false
+	}
+	return text, true
+}
+
+// 检测文本的编码并转换为UTF-8，依次判断BOM、UTF-8、GB18030，都不是时返回错误
+func detectText(data []byte, truncated bool) (charset string, text string, err error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		data = data[3:]
+		if truncated {
+			data = trimIncompleteUTF8(data)
+		}
+		return "UTF-8", string(bytes.ToValidUTF8(data, []byte(string(utf8.RuneError)))), nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		charset = "UTF-16LE"
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		charset = "UTF-16BE"
+	}
+	if len(charset) > 0 {
+		data = data[2:]
+		if len(data)%2 != 0 {
+			data = data[:len(data)-1]
+		}
+		if text, ok := decodeText(charset, data, truncated); ok {
+			return charset, text, nil
+		}
+		return "", "", gerror.New("不是文本文件")
+	}
+	if bytes.IndexByte(data, 0) != -1 || tooManyControlChars(data) {
+		return "", "", gerror.New("不是文本文件")
+	}
+	if truncated {
+		if trimmed := trimIncompleteUTF8(data); utf8.Valid(trimmed) {
+			return "UTF-8", string(trimmed), nil
+		}
+	} else if utf8.Valid(data) {
+		return "UTF-8", string(data), nil
+	}
+	if text, ok := decodeText("GB18030", data, truncated); ok {
+		return "GB18030", text, nil
+	}
+	return "", "", gerror.New("无法识别文本的编码")
+}
+
+// 读取文件开头的内容作为文本预览
+func previewText(f *os.File, info os.FileInfo, limit int64) (*TextPreview, error) {
+	data, err := io.ReadAll(io.LimitReader(f, limit))
+	if err != nil {
+		return nil, err
+	}
+	truncated := info.Size() > int64(len(data))
+	charset, text, err := detectText(data, truncated)
+	if err != nil {
+		return nil, err
+	}
+	return &TextPreview{Encoding: charset, Content: text, Truncated: truncated, Size: info.Size()}, nil
+}
+
+// 计算缩略图的尺寸，保持宽高比，不放大
+func thumbnailBounds(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	tw, th := maxW, h*maxW/w
+	if th > maxH {
+		tw, th = w*maxH/h, maxH
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	return tw, th
+}
+
+// 把图片缩小到指定尺寸，每个目标像素取对应区域内所有像素的平均值
+func scaleImage(src image.Image, dw, dh int) *image.RGBA {
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		// 标准库对常见的图片格式有快速的转换路径
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	sb := rgba.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*sh/dh, (dy+1)*sh/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*sw/dw, (dx+1)*sw/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				i := rgba.PixOffset(sb.Min.X+x0, sb.Min.Y+y)
+				for x := x0; x < x1; x++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					b += uint64(rgba.Pix[i+2])
+					a += uint64(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(dx, dy)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// 生成缩略图，jpeg生成jpeg，其他格式生成png保留透明度
+func makeThumbnail(f *os.File, info os.FileInfo, maxW, maxH int) (*thumbnail, error) {
+	if info.Size() > env.PreviewMaxImageSize() {
+		return nil, gerror.New("图片太大，无法预览")
+	}
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, gerror.New("不支持的图片格式")
+	}
+	if int64(config.Width)*int64(config.Height) > env.PreviewMaxImagePixels() {
+		return nil, gerror.New("图片太大，无法预览")
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, gerror.New("图片解码失败")
+	}
+	tw, th := thumbnailBounds(src.Bounds().Dx(), src.Bounds().Dy(), maxW, maxH)
+	dst := scaleImage(src, tw, th)
+	buf := new(bytes.Buffer)
+	if format == "jpeg" {
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 80})
+		return &thumbnail{contentType: "image/jpeg", data: buf.Bytes()}, err
+	}
+	err = png.Encode(buf, dst)
+	return &thumbnail{contentType: "image/png", data: buf.Bytes()}, err
+}
+
+// Preview 预览文件
+// 图片返回缩略图，通过width、height指定最大尺寸；其他文件按文本处理，返回开头size KB的内容和检测到的编码
+func (that *ControllerApiV1) Preview(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	rootDir := requestFileRoot(r, "root", FileRootDownloads, false).Path
+	path, err := safepath.Resolve(rootDir, r.GetString("path"))
+	if err != nil {
+		FailJson(true, r, err.Error())
+		return
+	}
+	var f *os.File
+	err = asDesktopUser(func() (e error) {
+		f, e = safepath.OpenFile(rootDir, safepath.Rel(rootDir, path), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		return e
+	})
+	if err != nil {
+		FailJson(true, r, "path not found")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		FailJson(true, r, "只能预览普通文件")
+		return
+	}
+	if thumbnailMimes[fileMime(info)] {
+		previewImage(r, f, path, info)
+		return
+	}
+	limit := r.GetInt64("size", defaultPreviewTextKB) * 1024
+	if limit <= 0 {
+		FailJson(true, r, "size参数有误")
+		return
+	}
+	if limit > env.PreviewMaxTextSize() {
+		limit = env.PreviewMaxTextSize()
+	}
+	preview, err := previewText(f, info, limit)
+	if err != nil {
+		FailJson(true, r, err.Error())
+		return
+	}
+	SusJson(true, r, "ok", preview)
+}
+
+// 返回图片的缩略图
+func previewImage(r *ghttp.Request, f *os.File, path string, info os.FileInfo) {
+	width := r.GetInt("width", defaultThumbnailSize)
+	height := r.GetInt("height", defaultThumbnailSize)
+	if width <= 0 || height <= 0 || width > maxThumbnailSize || height > maxThumbnailSize {
+		FailJson(true, r, fmt.Sprintf("缩略图尺寸必须在1到%d之间", maxThumbnailSize))
+		return
+	}
+	etag := fmt.Sprintf(`"%x-%x-%dx%d"`, info.ModTime().UnixNano(), info.Size(), width, height)
+	r.Response.Header().Set("ETag", etag)
+	r.Response.Header().Set("Cache-Control", "private, max-age=3600")
+	if r.Header.Get("If-None-Match") == etag {
+		r.Response.WriteHeader(304)
+		return
+	}
+	key := fmt.Sprintf("%s:%s", path, etag)
+	var thumb *thumbnail
+	if v, err := thumbnailCache.Get(key); err == nil && v != nil {
+		thumb, _ = v.(*thumbnail)
+	}
+	if thumb == nil {
+		var err error
+		thumb, err = makeThumbnail(f, info, width, height)
+		if err != nil {
+			FailJson(true, r, err.Error())
+			return
+		}
+		_ = thumbnailCache.Set(key, thumb, thumbnailCacheExpire)
+	}
+	r.Response.Header().Set("Content-Type", thumb.contentType)
+	r.Response.Write(thumb.data)
+}
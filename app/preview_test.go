@@ -0,0 +1,71 @@
+package app
+
+import (
+	"github.com/gogf/gf/encoding/gcharset"
+	"github.com/gogf/gf/test/gtest"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDetectText(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		charset, text, err := detectText([]byte("hello 世界"), false)
+		t.Assert(err, nil)
+		t.Assert(charset, "UTF-8")
+		t.Assert(text, "hello 世界")
+
+		// 截断在多字节字符中间时去掉不完整的字符
+		data := []byte("hello 世界")
+		charset, text, err = detectText(data[:len(data)-1], true)
+		t.Assert(err, nil)
+		t.Assert(charset, "UTF-8")
+		t.Assert(text, "hello 世")
+
+		gbk, err := gcharset.UTF8To("GB18030", "中文文本")
+		t.Assert(err, nil)
+		charset, text, err = detectText([]byte(gbk), false)
+		t.Assert(err, nil)
+		t.Assert(charset, "GB18030")
+		t.Assert(text, "中文文本")
+
+		charset, text, err = detectText([]byte{0xFF, 0xFE, 'h', 0, 'i', 0}, false)
+		t.Assert(err, nil)
+		t.Assert(charset, "UTF-16LE")
+		t.Assert(text, "hi")
+
+		_, _, err = detectText([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0}, false)
+		t.AssertNE(err, nil)
+	})
+}
+
+func TestScaleImage(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		w, h := thumbnailBounds(1000, 500, 256, 256)
+		t.Assert(w, 256)
+		t.Assert(h, 128)
+		w, h = thumbnailBounds(500, 1000, 256, 256)
+		t.Assert(w, 128)
+		t.Assert(h, 256)
+		w, h = thumbnailBounds(100, 50, 256, 256)
+		t.Assert(w, 100)
+		t.Assert(h, 50)
+
+		// 黑白相间的竖条缩小一半之后是灰色
+		src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+		for x := 0; x < 4; x++ {
+			for y := 0; y < 2; y++ {
+				if x%2 == 0 {
+					src.Set(x, y, color.White)
+				} else {
+					src.Set(x, y, color.Black)
+				}
+			}
+		}
+		dst := scaleImage(src, 2, 1)
+		t.Assert(dst.Bounds().Dx(), 2)
+		t.Assert(dst.Bounds().Dy(), 1)
+		t.Assert(dst.RGBAAt(0, 0).R, 127)
+		t.Assert(dst.RGBAAt(1, 0).A, 255)
+	})
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"agent/env"
+	"fmt"
+	"github.com/gogf/gf/net/ghttp"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// UploadUsage 上传目录的空间使用情况，单位字节
+type UploadUsage struct {
+	// 上传目录已使用的空间
+	Used int64 `json:"used"`
+	// 上传目录的配额，0表示不限制
+	Quota int64 `json:"quota"`
+	// 单个文件的最大长度，0表示不限制
+	MaxFileSize int64 `json:"maxFileSize"`
+	// 磁盘剩余空间，已扣除保留空间
+	Free int64 `json:"free"`
+	// 还可以上传的空间
+	Available int64 `json:"available"`
+}
+
+// 获取目录所在磁盘对普通用户可用的剩余空间
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// 统计目录占用的空间，目录不存在时返回0
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// 找到路径中最近一个存在的目录，用来统计磁盘空间
+func existingDir(path string) string {
+	for {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// 获取上传目录的空间使用情况
+func uploadUsage(rootDir string) (*UploadUsage, error) {
+	used, err := dirSize(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	free, err := diskFree(existingDir(rootDir))
+	if err != nil {
+		return nil, err
+	}
+	usage := &UploadUsage{
+		Used:        used,
+		Quota:       env.UploadQuota(),
+		MaxFileSize: env.UploadMaxFileSize(),
+		Free:        free - env.UploadReservedSpace(),
+	}
+	if usage.Free < 0 {
+		usage.Free = 0
+	}
+	usage.Available = usage.Free
+	if usage.Quota > 0 && usage.Quota-usage.Used < usage.Available {
+		usage.Available = usage.Quota - usage.Used
+	}
+	if usage.Available < 0 {
+		usage.Available = 0
+	}
+	return usage, nil
+}
+
+// 检查上传目录是否还能容纳指定长度的文件
+func checkUploadQuota(rootDir string, fileSize int64) error {
+	maxFileSize := env.UploadMaxFileSize()
+	if maxFileSize > 0 && fileSize > maxFileSize {
+		return fmt.Errorf("文件长度不能超过%d字节", maxFileSize)
+	}
+	usage, err := uploadUsage(rootDir)
+	if err != nil {
+		return fmt.Errorf("获取上传目录空间失败,err:%v", err)
+	}
+	if fileSize > usage.Available {
+		return fmt.Errorf("上传空间不足，需要%d字节，剩余%d字节", fileSize, usage.Available)
+	}
+	return nil
+}
+
+// 检查分片临时目录所在的磁盘是否还能容纳指定长度的分片
+func checkChunkSpace(chunkSize int64) error {
+	free, err := diskFree(existingDir(uploadTempDir()))
+	if err != nil {
+		return fmt.Errorf("获取临时目录空间失败,err:%v", err)
+	}
+	if chunkSize > free-env.UploadReservedSpace() {
+		return fmt.Errorf("临时目录空间不足")
+	}
+	return nil
+}
+
+// UploadQuota 查询上传目录的空间使用情况，前端在上传之前判断空间是否足够
+func (that *ControllerApiV1) UploadQuota(r *ghttp.Request) {
+	requirePermission(r, PermFileTransfer)
+	root := requestFileRoot(r, "root", FileRootUploads, true)
+	usage, err := uploadUsage(root.Path)
+	if err != nil {
+		FailJson(true, r, err.Error())
+	}
+	SusJson(true, r, "ok", usage)
+}
@@ -7,6 +7,10 @@ import (
 const (
 	SuccessCode int = 0
 	ErrorCode   int = -1
+	// UnauthenticatedCode 未登录或者登录已失效，前端收到后跳转到登录页
+	UnauthenticatedCode int = 401
+	// ForbiddenCode 已登录但是当前角色没有权限
+	ForbiddenCode int = 403
 )
 
 type Response struct {
@@ -58,3 +62,19 @@ func FailJson(isExit bool, r *ghttp.Request, msg string, data ...interface{}) {
 	}
 	RJson(r, ErrorCode, msg, data...)
 }
+
+// UnauthenticatedJson 未登录返回JSON
+func UnauthenticatedJson(isExit bool, r *ghttp.Request, msg string, data ...interface{}) {
+	if isExit {
+		JsonExit(r, UnauthenticatedCode, msg, data...)
+	}
+	RJson(r, UnauthenticatedCode, msg, data...)
+}
+
+// ForbiddenJson 没有权限返回JSON
+func ForbiddenJson(isExit bool, r *ghttp.Request, msg string, data ...interface{}) {
+	if isExit {
+		JsonExit(r, ForbiddenCode, msg, data...)
+	}
+	RJson(r, ForbiddenCode, msg, data...)
+}
@@ -2,14 +2,13 @@ package app
 
 import (
 	"agent/env"
+	"agent/pkg/auth"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/gogf/gf/frame/g"
 	"github.com/gogf/gf/net/ghttp"
-	"github.com/gogf/gf/os/gcache"
 	"github.com/osgochina/dmicro/easyservice"
 	"github.com/osgochina/dmicro/logger"
 	"github.com/osgochina/dmicro/supervisor/process"
-	"golang.org/x/net/websocket"
 	"net/http"
 )
 
@@ -21,6 +20,8 @@ type SandBoxServer struct {
 	svr         *ghttp.Server
 	procManager *process.Manager
 	vncSvr      *vncServer
+	// 网页端登录使用的认证后端
+	authenticator auth.Authenticator
 }
 
 var _ easyservice.ISandBox = new(SandBoxServer)
@@ -35,46 +36,100 @@ func NewSandBoxServer(svc *easyservice.EasyService) *SandBoxServer {
 	}
 	sandbox.svr = g.Server("vprix")
 	sandbox.svr.SetPort(env.VprixPort())
+	// 请求体的长度限制需要能容纳一个完整的上传分片
+	sandbox.svr.SetClientMaxBodySize(env.UploadMaxChunkSize() + 1024*1024)
 	sandbox.procManager = process.NewManager()
 	return sandbox
 }
+
+// MiddlewareCORS 只允许与agent同源或者配置在VPRIX_AGENT_ALLOWED_ORIGINS中的来源跨域访问
+// 登录状态保存在cookie中，其他来源带着Origin的请求直接拒绝，避免借用浏览器的登录状态修改文件、创建分享等
 func MiddlewareCORS(r *ghttp.Request) {
-	r.Response.CORSDefault()
+	if len(r.GetHeader("Origin")) > 0 {
+		if !checkOrigin(r.Request) {
+			logger.Warningf("拒绝跨域请求, origin:%s, path:%s", r.GetHeader("Origin"), r.URL.Path)
+			r.Response.WriteStatusExit(http.StatusForbidden)
+			return
+		}
+		options := r.Response.DefaultCORSOptions()
+		options.AllowOrigin = r.GetHeader("Origin")
+		r.Response.CORS(options)
+	}
+	r.Middleware.Next()
+}
+
+// MiddlewareWebSocketAuth websocket升级之前校验登录状态或分享token，校验失败直接返回http状态码
+func MiddlewareWebSocketAuth(r *ghttp.Request) {
+	visitor := authenticateRequest(r)
+	if visitor == nil {
+		logger.Warningf("websocket认证失败, ip:%s", r.GetClientIp())
+		if len(r.GetString("share_token")) > 0 || len(bearerToken(r)) > 0 {
+			r.Response.WriteStatusExit(http.StatusForbidden)
+			return
+		}
+		r.Response.WriteStatusExit(http.StatusUnauthorized)
+		return
+	}
+	if !visitor.Role.Can(PermView) {
+		r.Response.WriteStatusExit(http.StatusForbidden)
+		return
+	}
+	r.SetCtxVar(ctxKeyVisitor, visitor)
 	r.Middleware.Next()
 }
 
 // Setup 启动服务
 func (that *SandBoxServer) Setup() error {
+	var err error
+	that.authenticator, err = newAuthenticator()
+	if err != nil {
+		return err
+	}
+	logger.Infof("网页端登录使用的认证后端: %s", that.authenticator.Name())
 	that.svr.Group("/api/v1", func(group *ghttp.RouterGroup) {
-		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareCORS, MiddlewareAuth)
 		group.ALL("/", new(ControllerApiV1))
 	})
 	that.svr.Group("/websockify", func(group *ghttp.RouterGroup) {
 		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareWebSocketAuth)
 		group.ALL("/", func(r *ghttp.Request) {
-
-			//if !r.Session.GetVar("isLogin", false).Bool() {
-			//	logger.Warningf("用户未登录")
-			//	r.Exit()
-			//	return
-			//}
-			val, err := gcache.Get(StartWorkSpaceVncKey)
+			vncConnParams, err := getVncConnParams()
 			if err != nil {
-				logger.Error(err)
-				r.Exit()
-				return
-			}
-			if val == nil {
-				logger.Warningf("vnc服务未启动")
-				r.Exit()
+				logger.Warning(err)
+				r.Response.WriteStatusExit(http.StatusServiceUnavailable)
 				return
 			}
-			vncConnParams := val.(*VncConnParams)
-			vncProxy := NewWSVncProxy(vncConnParams)
-			h := websocket.Handler(vncProxy.Start)
-			h.ServeHTTP(r.Response.Writer, r.Request)
+			// 按照访问者的角色过滤客户端消息
+			vncProxy := NewWSVncProxy(vncConnParams, currentVisitor(r).Role)
+			serveWebSocket(r, vncProxy.Start)
 		})
 	})
+	that.svr.Group("/audio", func(group *ghttp.RouterGroup) {
+		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareWebSocketAuth)
+		group.ALL("/", audioWebSocket)
+	})
+	that.svr.Group("/microphone", func(group *ghttp.RouterGroup) {
+		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareWebSocketAuth)
+		group.ALL("/", micWebSocket)
+	})
+	that.svr.Group("/exec", func(group *ghttp.RouterGroup) {
+		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareWebSocketAuth)
+		group.ALL("/", execWebSocket)
+	})
+	that.svr.Group("/terminal", func(group *ghttp.RouterGroup) {
+		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareWebSocketAuth)
+		group.ALL("/", terminalWebSocket)
+	})
+	that.svr.Group("/clipboard", func(group *ghttp.RouterGroup) {
+		group.Middleware(MiddlewareCORS)
+		group.Middleware(MiddlewareWebSocketAuth)
+		group.ALL("/", clipboardWebSocket)
+	})
 	box := packr.New("novnc", "../assets/novnc")
 	that.svr.Group("/*", func(group *ghttp.RouterGroup) {
 		group.GET("/core/", func(r *ghttp.Request) {
@@ -85,6 +140,14 @@ func (that *SandBoxServer) Setup() error {
 		})
 	})
 
+	// 定期清理未完成的上传
+	go uploadGC.Start()
+
+	// 声音服务需要在桌面之前启动
+	if err = startAudio(); err != nil {
+		logger.Warningf("启动声音服务失败:%v", err)
+	}
+
 	that.vncSvr = NewVncServer()
 	go func() {
 		_, err := that.vncSvr.VncStart(&StartUser{UserName: env.User(), GroupName: env.User(), VncPasswd: env.VncPassword()})
@@ -98,6 +161,7 @@ func (that *SandBoxServer) Setup() error {
 
 // Shutdown 关闭服务
 func (that *SandBoxServer) Shutdown() error {
+	uploadGC.Stop()
 	that.procManager.StopAllProcesses()
 	return nil
 }
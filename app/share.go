@@ -0,0 +1,278 @@
+package app
+
+import (
+	"agent/env"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/frame/g"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/os/gcache"
+	"github.com/gogf/gf/os/gtime"
+	"github.com/gogf/gf/text/gstr"
+	"github.com/gogf/gf/util/grand"
+	"github.com/osgochina/dmicro/logger"
+	"time"
+)
+
+// 分享链接的读写模式
+const (
+	ShareModeRead      = "r"
+	ShareModeReadWrite = "rw"
+)
+
+// 分享链接默认的有效期
+const defaultShareExpire = 2 * time.Hour
+
+// 分享token中被签名的内容
+type sharePayload struct {
+	Uid            int    `json:"uid"`
+	Role           string `json:"role"`
+	Nickname       string `json:"nickname"`
+	ExpirationTime int64  `json:"exp"`
+	Nonce          string `json:"nonce"`
+}
+
+// shareManager 负责分享token的签发、校验和吊销，token本身存放在gcache中
+type shareManager struct {
+	secret []byte
+}
+
+var shares = newShareManager(env.ShareSecret())
+
+func newShareManager(secret string) *shareManager {
+	if len(secret) <= 0 {
+		// 未配置密钥时使用随机密钥，agent重启后之前签发的分享链接全部失效
+		secret = grand.S(32)
+	}
+	return &shareManager{secret: []byte(secret)}
+}
+
+// 计算签名
+func (that *shareManager) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, that.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Create 签发分享token，并把分享参数存入缓存，缓存时间就是分享的有效期
+// 分享只能授予协作者或观看者角色
+func (that *shareManager) Create(uid int, role Role, nickname string, vncToken string, expire time.Duration) (*ShareConnParams, error) {
+	if role != RoleCollaborator && role != RoleViewer {
+		return nil, gerror.Newf("不支持分享的角色:%s", role)
+	}
+	if expire <= 0 {
+		return nil, gerror.New("分享有效期必须大于0")
+	}
+	now := gtime.Now()
+	expiration := now.Add(expire)
+	payload, err := json.Marshal(&sharePayload{
+		Uid:            uid,
+		Role:           string(role),
+		Nickname:       nickname,
+		ExpirationTime: expiration.Unix(),
+		Nonce:          grand.S(16),
+	})
+	if err != nil {
+		return nil, err
+	}
+	shareToken := base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(that.sign(payload))
+	params := &ShareConnParams{
+		RW:             role.RW(),
+		Role:           string(role),
+		Uid:            uid,
+		Nickname:       nickname,
+		Token:          vncToken,
+		ShareToken:     shareToken,
+		ShareTime:      now,
+		ExpirationTime: expiration,
+	}
+	err = gcache.Set(shareToken, params, expire)
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Verify 校验分享token，签名不对、已过期或者已被吊销的token都会被拒绝
+func (that *shareManager) Verify(shareToken string) (*ShareConnParams, error) {
+	parts := gstr.Split(shareToken, ".")
+	if len(parts) != 2 {
+		return nil, gerror.New("token格式错误")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, gerror.New("token格式错误")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, gerror.New("token格式错误")
+	}
+	if !hmac.Equal(signature, that.sign(payload)) {
+		return nil, gerror.New("token签名错误")
+	}
+	p := new(sharePayload)
+	err = json.Unmarshal(payload, p)
+	if err != nil {
+		return nil, gerror.New("token格式错误")
+	}
+	if gtime.Timestamp() >= p.ExpirationTime {
+		return nil, gerror.New("分享链接已过期")
+	}
+	data, err := gcache.Get(shareToken)
+	if err != nil {
+		return nil, err
+	}
+	params, ok := data.(*ShareConnParams)
+	if !ok || params == nil {
+		return nil, gerror.New("分享链接已失效")
+	}
+	if params.ExpirationTime == nil || !params.ExpirationTime.After(gtime.Now()) {
+		return nil, gerror.New("分享链接已过期")
+	}
+	if params.Uid != p.Uid || params.Role != p.Role || params.Nickname != p.Nickname {
+		return nil, gerror.New("分享链接已失效")
+	}
+	return params, nil
+}
+
+// List 列出某个用户还在有效期内的分享
+func (that *shareManager) List(uid int) []*ShareConnParams {
+	var list []*ShareConnParams
+	values, err := gcache.Values()
+	if err != nil {
+		logger.Warning(err)
+		return list
+	}
+	now := gtime.Now()
+	for _, v := range values {
+		params, ok := v.(*ShareConnParams)
+		if !ok || params.Uid != uid {
+			continue
+		}
+		if params.ExpirationTime == nil || !params.ExpirationTime.After(now) {
+			continue
+		}
+		list = append(list, params)
+	}
+	return list
+}
+
+// Revoke 吊销分享，只允许分享的创建者吊销
+func (that *shareManager) Revoke(uid int, shareToken string) error {
+	data, err := gcache.Get(shareToken)
+	if err != nil {
+		return err
+	}
+	params, ok := data.(*ShareConnParams)
+	if !ok || params == nil || params.Uid != uid {
+		return gerror.New("分享不存在")
+	}
+	_, err = gcache.Remove(shareToken)
+	return err
+}
+
+// CreateShare 创建分享链接，通过role参数指定分享的角色，兼容旧的rw参数
+func (that *ControllerApiV1) CreateShare(r *ghttp.Request) {
+	requirePermission(r, PermShare)
+	visitor := currentVisitor(r)
+	uid := visitor.Uid
+	role := roleFromRW(r.GetString("rw", ShareModeRead))
+	if name := r.GetString("role"); len(name) > 0 {
+		var ok bool
+		role, ok = ParseRole(name)
+		if !ok {
+			FailJson(true, r, "角色不正确")
+			return
+		}
+	}
+	nickname := r.GetString("nickname", visitor.Username)
+	expire := time.Duration(r.GetInt("expire", int(defaultShareExpire/time.Second))) * time.Second
+	if expire <= 0 || expire > time.Duration(env.ShareMaxExpire())*time.Second {
+		FailJson(true, r, "分享有效期不正确")
+		return
+	}
+	vncConnParams, err := getVncConnParams()
+	if err != nil {
+		logger.Warning(err)
+		FailJson(true, r, "获取vnc信息失败")
+		return
+	}
+	shareConnParams, err := shares.Create(uid, role, nickname, vncConnParams.Token, expire)
+	if err != nil {
+		FailJson(true, r, err.Error())
+		return
+	}
+	logger.Infof("创建分享：uid=%d role=%s nickname=%s expiration=%s", uid, role, nickname, shareConnParams.ExpirationTime)
+	SusJson(true, r, "ok", shareConnParams)
+}
+
+// ShareList 列出当前用户有效的分享链接
+func (that *ControllerApiV1) ShareList(r *ghttp.Request) {
+	requirePermission(r, PermShare)
+	uid := currentVisitor(r).Uid
+	SusJson(true, r, "ok", shares.List(uid))
+}
+
+// RevokeShare 吊销分享链接
+func (that *ControllerApiV1) RevokeShare(r *ghttp.Request) {
+	requirePermission(r, PermShare)
+	uid := currentVisitor(r).Uid
+	token := r.GetString("token")
+	if len(token) <= 0 {
+		FailJson(true, r, "获取token失败")
+		return
+	}
+	err := shares.Revoke(uid, token)
+	if err != nil {
+		FailJson(true, r, err.Error())
+		return
+	}
+	logger.Infof("吊销分享：uid=%d", uid)
+	SusJson(true, r, "ok")
+}
+
+// Share 通过分享链接中的token，获取vnc链接信息
+// 不返回vnc密码，proxy连接vnc服务时在服务端完成认证，浏览器端不需要密码
+func (that *ControllerApiV1) Share(r *ghttp.Request) {
+	token := r.GetString("token")
+	if len(token) <= 0 {
+		FailJson(true, r, "获取token失败")
+		return
+	}
+	shareConnParams, err := shares.Verify(token)
+	if err != nil {
+		logger.Warning(err)
+		FailJson(true, r, err.Error())
+		return
+	}
+	params, err := gcache.Get(shareConnParams.Token)
+	if err != nil {
+		logger.Warning(err)
+		FailJson(true, r, "获取params信息失败")
+		return
+	}
+	if params == nil {
+		FailJson(true, r, "获取params信息失败")
+		return
+	}
+	p, ok := params.(*VncConnParams)
+	if !ok {
+		FailJson(true, r, "获取params信息失败")
+		return
+	}
+	logger.Infof("分享桌面：%v", shareConnParams)
+	d := g.Map{
+		"token":           p.Token,
+		"nickname":        shareConnParams.Nickname,
+		"host":            g.Cfg().GetString("base_url"),
+		"path":            "/proxy/v1/websockify",
+		"rw":              shareConnParams.RW,
+		"role":            shareConnParams.Role,
+		"expiration_time": shareConnParams.ExpirationTime,
+	}
+	SusJson(true, r, "ok", d)
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"testing"
+	"time"
+)
+
+func TestShareManager(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		m := newShareManager("test-secret")
+		params, err := m.Create(1000, RoleViewer, "student", "vnc-token", time.Minute)
+		t.Assert(err, nil)
+		t.Assert(params.RW, ShareModeRead)
+		t.Assert(params.Role, RoleViewer)
+		t.Assert(params.Token, "vnc-token")
+
+		p, err := m.Verify(params.ShareToken)
+		t.Assert(err, nil)
+		t.Assert(p.Nickname, "student")
+		t.Assert(len(m.List(1000)) > 0, true)
+		t.Assert(len(m.List(1001)), 0)
+
+		// 其他密钥签发的token不能通过校验
+		other := newShareManager("other-secret")
+		_, err = other.Verify(params.ShareToken)
+		t.AssertNE(err, nil)
+
+		// 篡改过的token不能通过校验
+		_, err = m.Verify("x" + params.ShareToken)
+		t.AssertNE(err, nil)
+
+		// 只有创建者可以吊销
+		t.AssertNE(m.Revoke(1001, params.ShareToken), nil)
+		t.Assert(m.Revoke(1000, params.ShareToken), nil)
+		_, err = m.Verify(params.ShareToken)
+		t.AssertNE(err, nil)
+
+		_, err = m.Create(1000, RoleOwner, "student", "vnc-token", time.Minute)
+		t.AssertNE(err, nil)
+	})
+}
+
+func TestShareManager_Expire(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		m := newShareManager("test-secret")
+		params, err := m.Create(1000, RoleCollaborator, "student", "vnc-token", time.Second)
+		t.Assert(err, nil)
+		time.Sleep(1100 * time.Millisecond)
+		_, err = m.Verify(params.ShareToken)
+		t.AssertNE(err, nil)
+	})
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"agent/env"
+	"agent/pkg/customexec"
+	"agent/pkg/fsuser"
+	"agent/pkg/pty"
+	"encoding/json"
+	"fmt"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/os/gfile"
+	"github.com/osgochina/dmicro/logger"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// 终端窗口允许的最大行数和列数
+const maxTerminalSize = 1000
+
+// 结束终端时，发送SIGHUP之后等待进程退出的时间
+const terminalKillWait = 3 * time.Second
+
+// terminalControl 客户端以文本消息发送的控制消息
+type terminalControl struct {
+	// resize调整窗口大小，input写入输入
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+	Data string `json:"data"`
+}
+
+// 检查窗口大小是否有效
+func validTerminalSize(cols, rows int) bool {
+	return cols > 0 && rows > 0 && cols <= maxTerminalSize && rows <= maxTerminalSize
+}
+
+// 终端使用的shell，配置的shell不存在时使用/bin/sh
+func terminalShell() string {
+	if shell := env.TerminalShell(); gfile.IsFile(shell) {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+// 以桌面用户的身份在伪终端中启动登录shell
+func startTerminal(cols, rows int) (*customexec.Cmd, *os.File, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tty.Close()
+	// 和登录时一样把终端交给用户，否则tty、mesg等命令无法使用
+	if cred, e := fsuser.Lookup(env.User()); e == nil {
+		_ = os.Chown(tty.Name(), cred.Uid, cred.Gid)
+		_ = os.Chmod(tty.Name(), 0620)
+	}
+	if err = pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}); err != nil {
+		_ = ptmx.Close()
+		return nil, nil, err
+	}
+	shell := terminalShell()
+	cmd := customexec.Command(shell, "-l")
+	cmd.Dir = env.Home()
+	cmd.Env = customexec.UserEnv(env.User(), "TERM=xterm-256color", "SHELL="+shell)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	// 无法切换到桌面用户时不能启动终端，否则会得到一个root的shell
+	if err = cmd.SetUser(); err != nil {
+		_ = ptmx.Close()
+		return nil, nil, fmt.Errorf("切换到桌面用户[%s]失败:%v", env.User(), err)
+	}
+	// 新的会话，伪终端作为控制终端
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	if err = cmd.Start(); err != nil {
+		_ = ptmx.Close()
+		return nil, nil, err
+	}
+	return cmd, ptmx, nil
+}
+
+// 结束终端中的进程，先发送SIGHUP，一段时间后还没有退出时强制结束整个会话
+func stopTerminal(cmd *customexec.Cmd, exited chan struct{}) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+	select {
+	case <-exited:
+	case <-time.After(terminalKillWait):
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+	}
+}
+
+// 网页终端的websocket通道，以桌面用户的身份启动shell
+// cols、rows指定初始的窗口大小，默认80x24
+// 服务端以二进制消息发送终端的输出，可以直接交给xterm.js的write；
+// 客户端以二进制消息发送输入，或者以文本消息发送json格式的terminalControl，
+// {"type":"input","data":"ls\r"}写入输入，{"type":"resize","cols":120,"rows":40}调整窗口大小
+// shell退出后服务端关闭连接
+func terminalWebSocket(r *ghttp.Request) {
+	visitor := currentVisitor(r)
+	if visitor == nil || !visitor.Role.Can(PermExec) {
+		r.Response.WriteStatusExit(http.StatusForbidden)
+		return
+	}
+	cols, rows := r.GetInt("cols", 80), r.GetInt("rows", 24)
+	if !validTerminalSize(cols, rows) {
+		r.Response.WriteStatusExit(http.StatusBadRequest, fmt.Sprintf("窗口大小必须在1到%d之间", maxTerminalSize))
+		return
+	}
+	serveWebSocket(r, func(ws *websocket.Conn) {
+		defer ws.Close()
+		cmd, ptmx, err := startTerminal(cols, rows)
+		if err != nil {
+			logger.Warningf("启动终端失败:%v", err)
+			_ = websocket.Message.Send(ws, fmt.Sprintf("启动终端失败:%v\r\n", err))
+			return
+		}
+		defer ptmx.Close()
+		logger.Infof("打开终端, username:%s, pid:%d", visitor.Username, cmd.Process.Pid)
+		exited := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(exited)
+		}()
+		// shell退出后，后台进程可能还占用着终端，稍等片刻读完剩余的输出后关闭终端
+		go func() {
+			<-exited
+			time.Sleep(time.Second)
+			_ = ptmx.Close()
+		}()
+		// 读取客户端的输入，连接断开时结束shell
+		go func() {
+			defer stopTerminal(cmd, exited)
+			for {
+				msg := new(wsMessage)
+				if err := wsMessageCodec.Receive(ws, msg); err != nil {
+					return
+				}
+				if msg.binary {
+					_, _ = ptmx.Write(msg.data)
+					continue
+				}
+				ctrl := new(terminalControl)
+				if err := json.Unmarshal(msg.data, ctrl); err != nil {
+					logger.Debugf("终端控制消息格式错误:%v", err)
+					continue
+				}
+				switch ctrl.Type {
+				case "input":
+					_, _ = ptmx.Write([]byte(ctrl.Data))
+				case "resize":
+					if validTerminalSize(ctrl.Cols, ctrl.Rows) {
+						_ = pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(ctrl.Rows), Cols: uint16(ctrl.Cols)})
+					}
+				}
+			}
+		}()
+		// shell和它的子进程都退出后读取会返回错误
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := ptmx.Read(buf)
+			if n > 0 {
+				if e := websocket.Message.Send(ws, buf[:n]); e != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		<-exited
+		logger.Infof("关闭终端, username:%s, exitCode:%d", visitor.Username, cmd.ProcessState.ExitCode())
+	})
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"agent/env"
+	"github.com/osgochina/dmicro/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// 旧版本直接存放在/tmp下的分片文件名 <md5>_<分片编号><扩展名>
+var legacyChunkRegex = regexp.MustCompile(`^[0-9a-f]{32}_\d+(\.[^/]*)?$`)
+
+// uploadJanitor 按identifier跟踪上传会话，定期清理长时间没有活动的分片
+type uploadJanitor struct {
+	mu sync.Mutex
+	// 每个上传会话最后一次活动的时间
+	activity map[string]time.Time
+	// 正在合并的上传会话，合并期间不能清理
+	merging     map[string]bool
+	idleTimeout time.Duration
+	interval    time.Duration
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+var uploadGC = newUploadJanitor(
+	time.Duration(env.UploadIdleTimeout())*time.Second,
+	time.Duration(env.UploadGCInterval())*time.Second,
+)
+
+func newUploadJanitor(idleTimeout time.Duration, interval time.Duration) *uploadJanitor {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	return &uploadJanitor{
+		activity:    make(map[string]time.Time),
+		merging:     make(map[string]bool),
+		idleTimeout: idleTimeout,
+		interval:    interval,
+		closed:      make(chan struct{}),
+	}
+}
+
+// Touch 记录上传会话的活动
+func (that *uploadJanitor) Touch(fileMd5 string) {
+	that.mu.Lock()
+	that.activity[fileMd5] = time.Now()
+	that.mu.Unlock()
+}
+
+// BeginMerge 开始合并，返回false表示该上传正在被其他请求合并
+func (that *uploadJanitor) BeginMerge(fileMd5 string) bool {
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	if that.merging[fileMd5] {
+		return false
+	}
+	that.merging[fileMd5] = true
+	that.activity[fileMd5] = time.Now()
+	return true
+}
+
+// EndMerge 合并结束，分片已经被删除，不再跟踪该会话
+func (that *uploadJanitor) EndMerge(fileMd5 string) {
+	that.mu.Lock()
+	delete(that.merging, fileMd5)
+	delete(that.activity, fileMd5)
+	that.mu.Unlock()
+}
+
+// Start 启动时先清理一次，然后定期清理
+func (that *uploadJanitor) Start() {
+	if that.idleTimeout <= 0 {
+		logger.Info("未完成上传的自动清理已关闭")
+		return
+	}
+	that.cleanLegacy()
+	that.Clean()
+	ticker := time.NewTicker(that.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			that.Clean()
+		case <-that.closed:
+			return
+		}
+	}
+}
+
+// Stop 停止定期清理
+func (that *uploadJanitor) Stop() {
+	that.closeOnce.Do(func() {
+		close(that.closed)
+	})
+}
+
+// Clean 清理超过空闲时间的分片目录
+func (that *uploadJanitor) Clean() {
+	dir := uploadTempDir()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("读取分片目录[%s]失败:%v", dir, err)
+		}
+		return
+	}
+	now := time.Now()
+	that.mu.Lock()
+	defer that.mu.Unlock()
+	// 只查询过、还没有上传分片的会话没有分片目录，空闲超时后同样不再跟踪
+	exists := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		exists[entry.Name()] = true
+	}
+	for fileMd5, t := range that.activity {
+		if !exists[fileMd5] && !that.merging[fileMd5] && now.Sub(t) >= that.idleTimeout {
+			delete(that.activity, fileMd5)
+		}
+	}
+	for _, entry := range entries {
+		fileMd5 := entry.Name()
+		if that.merging[fileMd5] {
+			continue
+		}
+		// 分片目录的修改时间就是最后一个分片写入的时间
+		last := entry.ModTime()
+		if t, ok := that.activity[fileMd5]; ok && t.After(last) {
+			last = t
+		}
+		if now.Sub(last) < that.idleTimeout {
+			continue
+		}
+		path := filepath.Join(dir, fileMd5)
+		// 无论分片目录是否删除成功，这个会话都已经过期，不再跟踪
+		delete(that.activity, fileMd5)
+		if err = os.RemoveAll(path); err != nil {
+			logger.Warningf("清理未完成的上传[%s]失败:%v", path, err)
+			continue
+		}
+		logger.Infof("清理未完成的上传[%s]，最后活动时间:%s", fileMd5, last.Format("2006-01-02 15:04:05"))
+	}
+}
+
+// 清理旧版本遗留在/tmp下的分片文件
+func (that *uploadJanitor) cleanLegacy() {
+	entries, err := ioutil.ReadDir("/tmp")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !legacyChunkRegex.MatchString(entry.Name()) {
+			continue
+		}
+		path := filepath.Join("/tmp", entry.Name())
+		if err = os.Remove(path); err == nil {
+			logger.Infof("清理旧版本遗留的分片文件[%s]", path)
+		}
+	}
+}
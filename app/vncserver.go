@@ -96,11 +96,26 @@ func (that *vncServer) VncStart(user *StartUser) (*VncConnParams, error) {
 		VncPasswd: user.VncPasswd,
 		Host:      "127.0.0.1",
 		Port:      5900,
+		Token:     grand.S(32),
 	}
 	_ = gcache.Set(StartWorkSpaceVncKey, conn, 0)
+	// 分享链接通过token找到对应的vnc链接信息
+	_ = gcache.Set(conn.Token, conn, 0)
 	return conn, nil
 }
 
+// 获取已启动的vnc服务的链接信息
+func getVncConnParams() (*VncConnParams, error) {
+	val, err := gcache.Get(StartWorkSpaceVncKey)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, gerror.New("vnc服务未启动")
+	}
+	return val.(*VncConnParams), nil
+}
+
 // Init 初始化参数
 func (that *vncServer) init(user *StartUser) {
 	that.home = user.Home
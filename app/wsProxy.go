@@ -12,18 +12,44 @@ import (
 	"time"
 )
 
+// 只读模式下需要丢弃的客户端消息，这些消息都会修改桌面的状态
+var readOnlyDisableMessageType = []rfb.MessageType{
+	rfb.MessageType(rfb.KeyEvent),
+	rfb.MessageType(rfb.PointerEvent),
+	rfb.MessageType(rfb.ClientCutText),
+	rfb.MessageType(rfb.SetDesktopSize),
+	rfb.MessageType(rfb.QEMUExtendedKeyEvent),
+}
+
 type WSVncProxy struct {
 	vncConnParams *VncConnParams
+	// 访问者的角色，没有输入权限的角色不转发键盘鼠标和剪切板消息
+	role Role
 }
 
 // NewWSVncProxy 生成vnc proxy服务对象
-func NewWSVncProxy(vncConnParams *VncConnParams) *WSVncProxy {
+func NewWSVncProxy(vncConnParams *VncConnParams, role Role) *WSVncProxy {
 	vncProxy := &WSVncProxy{
 		vncConnParams: vncConnParams,
+		role:          role,
 	}
 	return vncProxy
 }
 
+// ReadOnly 是否只读会话
+func (that *WSVncProxy) ReadOnly() bool {
+	return !that.role.Can(PermInput)
+}
+
+// 生成客户端消息的过滤规则，proxy转发给vnc服务端之前会跳过被禁用的消息
+func (that *WSVncProxy) optDisableMessageType() rfb.Option {
+	return func(options *rfb.Options) {
+		if that.ReadOnly() {
+			options.DisableMessageType = append(options.DisableMessageType, readOnlyDisableMessageType...)
+		}
+	}
+}
+
 // Start 启动
 func (that *WSVncProxy) Start(ws *websocket.Conn) {
 	ws.PayloadType = websocket.BinaryFrame
@@ -52,6 +78,7 @@ func (that *WSVncProxy) Start(ws *websocket.Conn) {
 		rfb.OptGetConn(func(sess rfb.ISession) (io.ReadWriteCloser, error) {
 			return net.DialTimeout(targetCfg.GetNetwork(), targetCfg.Addr(), targetCfg.GetTimeout())
 		}),
+		that.optDisableMessageType(),
 	)
 	p := vnc.NewVncProxy(cliSess, svrSess)
 	err = p.Start()
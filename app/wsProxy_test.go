@@ -0,0 +1,31 @@
+package app
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"github.com/vprix/vncproxy/rfb"
+	"testing"
+)
+
+func TestWSVncProxy_ReadOnly(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		options := rfb.Options{}
+		p := NewWSVncProxy(&VncConnParams{}, RoleViewer)
+		t.Assert(p.ReadOnly(), true)
+		p.optDisableMessageType()(&options)
+		disabled := map[rfb.MessageType]bool{}
+		for _, typ := range options.DisableMessageType {
+			disabled[typ] = true
+		}
+		t.Assert(disabled[rfb.MessageType(rfb.KeyEvent)], true)
+		t.Assert(disabled[rfb.MessageType(rfb.PointerEvent)], true)
+		t.Assert(disabled[rfb.MessageType(rfb.ClientCutText)], true)
+		t.Assert(disabled[rfb.MessageType(rfb.FramebufferUpdateRequest)], false)
+		t.Assert(disabled[rfb.MessageType(rfb.SetEncodings)], false)
+
+		options = rfb.Options{}
+		p = NewWSVncProxy(&VncConnParams{}, RoleCollaborator)
+		t.Assert(p.ReadOnly(), false)
+		p.optDisableMessageType()(&options)
+		t.Assert(len(options.DisableMessageType), 0)
+	})
+}
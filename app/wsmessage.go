@@ -0,0 +1,19 @@
+package app
+
+import "golang.org/x/net/websocket"
+
+// wsMessage websocket收到的一个消息
+type wsMessage struct {
+	binary bool
+	data   []byte
+}
+
+// 读取websocket消息时保留消息类型，用于区分二进制的数据消息和文本的控制消息
+var wsMessageCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		msg := v.(*wsMessage)
+		msg.binary = payloadType == websocket.BinaryFrame
+		msg.data = data
+		return nil
+	},
+}
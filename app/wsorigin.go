@@ -0,0 +1,51 @@
+package app
+
+import (
+	"agent/env"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/net/ghttp"
+	"github.com/gogf/gf/text/gstr"
+	"github.com/osgochina/dmicro/logger"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+)
+
+// 检查请求的Origin，只允许与agent同源或者配置在VPRIX_AGENT_ALLOWED_ORIGINS中的来源
+// 登录状态保存在cookie中，不检查Origin时，用户访问的任何网站都可以借用浏览器的登录状态连接agent
+// 浏览器总是会带上Origin，没有Origin的请求来自非浏览器的客户端，允许访问
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	if gstr.Equal(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range gstr.SplitAndTrim(env.AllowedOrigins(), ",") {
+		if gstr.Equal(gstr.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// 以websocket协议处理请求，握手时检查Origin，不允许的来源返回403
+func serveWebSocket(r *ghttp.Request, handler websocket.Handler) {
+	s := websocket.Server{
+		Handler: handler,
+		Handshake: func(config *websocket.Config, req *http.Request) (err error) {
+			if !checkOrigin(req) {
+				logger.Warningf("拒绝websocket连接, origin:%s, path:%s", req.Header.Get("Origin"), req.URL.Path)
+				return gerror.Newf("不允许的来源:%s", req.Header.Get("Origin"))
+			}
+			config.Origin, err = websocket.Origin(config, req)
+			return err
+		},
+	}
+	s.ServeHTTP(r.Response.Writer, r.Request)
+}
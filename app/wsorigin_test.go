@@ -0,0 +1,35 @@
+package app
+
+import (
+	"github.com/gogf/gf/os/genv"
+	"github.com/gogf/gf/test/gtest"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		t.Assert(genv.Set("VPRIX_AGENT_ALLOWED_ORIGINS", "https://desktop.example.com/, https://other.example.com"), nil)
+		defer genv.Remove("VPRIX_AGENT_ALLOWED_ORIGINS")
+		cases := []struct {
+			origin string
+			ok     bool
+		}{
+			{"", true},
+			{"http://agent.local:8080", true},
+			{"https://desktop.example.com", true},
+			{"https://other.example.com", true},
+			{"https://evil.example.com", false},
+			{"http://agent.local:8081", false},
+			{"https://desktop.example.com.evil.com", false},
+			{"null", false},
+		}
+		for _, c := range cases {
+			r := httptest.NewRequest("GET", "http://agent.local:8080/terminal", nil)
+			if len(c.origin) > 0 {
+				r.Header.Set("Origin", c.origin)
+			}
+			t.Assert(checkOrigin(r), c.ok)
+		}
+	})
+}
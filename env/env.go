@@ -5,6 +5,7 @@ import "github.com/gogf/gf/os/genv"
 const (
 	VprixAgentLoginUsername = "VPRIX_AGENT_LOGIN_USERNAME"
 	VprixAgentLoginPassword = "VPRIX_AGENT_LOGIN_PASSWORD"
+	VprixAgentShareSecret   = "VPRIX_AGENT_SHARE_SECRET"
 )
 
 // UserName 获取网页端登录的用户名
@@ -17,6 +18,184 @@ func Password() string {
 	return genv.Get(VprixAgentLoginPassword, "vprix")
 }
 
+// ShareSecret 获取分享链接签名使用的密钥，未设置时返回空字符串，由调用方生成随机密钥
+func ShareSecret() string {
+	return genv.Get(VprixAgentShareSecret, "")
+}
+
+// ShareMaxExpire 获取分享链接的最长有效期，单位秒，默认7天
+func ShareMaxExpire() int {
+	return genv.GetVar("VPRIX_AGENT_SHARE_MAX_EXPIRE", 7*24*3600).Int()
+}
+
+// AuthBackend 获取网页端登录使用的认证后端，可选 env、htpasswd、shadow、jwt，多个用逗号分隔，按顺序尝试
+// shadow后端只支持SHA-256($5$)和SHA-512($6$)格式的密码，桌面用户的密码是其他格式(例如yescrypt)时agent无法启动
+func AuthBackend() string {
+	return genv.Get("VPRIX_AGENT_AUTH_BACKEND", "env")
+}
+
+// HtpasswdFile 获取htpasswd认证后端使用的文件路径
+func HtpasswdFile() string {
+	return genv.Get("VPRIX_AGENT_HTPASSWD_FILE", "/etc/vprix/htpasswd")
+}
+
+// JWTSecret 获取jwt认证后端校验签名使用的密钥
+func JWTSecret() string {
+	return genv.Get("VPRIX_AGENT_JWT_SECRET", "")
+}
+
+// JWTIssuer 获取jwt认证后端要求的签发者，为空则不校验
+func JWTIssuer() string {
+	return genv.Get("VPRIX_AGENT_JWT_ISSUER", "")
+}
+
+// JWTAudience 获取jwt认证后端要求的接收者，为空则不校验
+func JWTAudience() string {
+	return genv.Get("VPRIX_AGENT_JWT_AUDIENCE", "")
+}
+
+// AllowedOrigins 获取允许跨域访问接口和发起websocket连接的来源，多个用逗号分隔，例如 https://desktop.example.com
+// 与agent同源的页面总是允许，通过反向代理访问并且代理修改了Host时需要配置
+func AllowedOrigins() string {
+	return genv.Get("VPRIX_AGENT_ALLOWED_ORIGINS", "")
+}
+
+// LoginUseBlacklist 网页端登录多次失败后是否临时拒绝该ip或用户登录，默认打开
+func LoginUseBlacklist() bool {
+	return genv.GetVar("VPRIX_AGENT_LOGIN_USE_BLACKLIST", true).Bool()
+}
+
+// LoginBlacklistThreshold 网页端登录被临时拒绝之前允许失败的次数，默认是5
+func LoginBlacklistThreshold() int {
+	return genv.GetVar("VPRIX_AGENT_LOGIN_BLACKLIST_THRESHOLD", 5).Int()
+}
+
+// LoginBlacklistTimeout 网页端登录首次被拒绝的秒数，之后每次失败翻倍，默认是10
+func LoginBlacklistTimeout() int {
+	return genv.GetVar("VPRIX_AGENT_LOGIN_BLACKLIST_TIMEOUT", 10).Int()
+}
+
+// LoginBlacklistMaxTimeout 网页端登录被拒绝的最长秒数，默认是3600
+func LoginBlacklistMaxTimeout() int {
+	return genv.GetVar("VPRIX_AGENT_LOGIN_BLACKLIST_MAX_TIMEOUT", 3600).Int()
+}
+
+// FileRoots 获取文件接口可以访问的目录，多个用逗号分隔，格式为 名称:路径[:r|rw]，路径中的~表示家目录，默认可读写
+func FileRoots() string {
+	return genv.Get("VPRIX_AGENT_FILE_ROOTS", "downloads:~/Downloads:rw,uploads:~/Uploads:rw")
+}
+
+// UploadTempDir 获取上传文件时分片存放的目录
+func UploadTempDir() string {
+	return genv.Get("VPRIX_AGENT_UPLOAD_TEMP_DIR", "/tmp/vprix-uploads")
+}
+
+// UploadMaxChunkSize 获取上传文件时单个分片的最大长度，单位字节，默认64MB
+func UploadMaxChunkSize() int64 {
+	return genv.GetVar("VPRIX_AGENT_UPLOAD_MAX_CHUNK_SIZE", 64*1024*1024).Int64()
+}
+
+// UploadMaxFileSize 获取单个上传文件的最大长度，单位字节，0表示不限制
+func UploadMaxFileSize() int64 {
+	return genv.GetVar("VPRIX_AGENT_UPLOAD_MAX_FILE_SIZE", 0).Int64()
+}
+
+// UploadQuota 获取上传目录允许使用的总空间，单位字节，0表示不限制
+func UploadQuota() int64 {
+	return genv.GetVar("VPRIX_AGENT_UPLOAD_QUOTA", 0).Int64()
+}
+
+// UploadReservedSpace 获取上传时磁盘需要保留的剩余空间，单位字节，默认256MB
+func UploadReservedSpace() int64 {
+	return genv.GetVar("VPRIX_AGENT_UPLOAD_RESERVED_SPACE", 256*1024*1024).Int64()
+}
+
+// UploadIdleTimeout 获取未完成的上传在多少秒没有活动后被清理，默认24小时
+func UploadIdleTimeout() int {
+	return genv.GetVar("VPRIX_AGENT_UPLOAD_IDLE_TIMEOUT", 24*3600).Int()
+}
+
+// UploadGCInterval 获取清理未完成上传的间隔秒数，默认10分钟
+func UploadGCInterval() int {
+	return genv.GetVar("VPRIX_AGENT_UPLOAD_GC_INTERVAL", 600).Int()
+}
+
+// PreviewMaxTextSize 获取文本预览最多读取的长度，单位字节，默认1MB
+func PreviewMaxTextSize() int64 {
+	return genv.GetVar("VPRIX_AGENT_PREVIEW_MAX_TEXT_SIZE", 1024*1024).Int64()
+}
+
+// PreviewMaxImageSize 获取可以生成缩略图的图片文件的最大长度，单位字节，默认32MB
+func PreviewMaxImageSize() int64 {
+	return genv.GetVar("VPRIX_AGENT_PREVIEW_MAX_IMAGE_SIZE", 32*1024*1024).Int64()
+}
+
+// PreviewMaxImagePixels 获取可以生成缩略图的图片的最大像素数，避免解码超大图片耗尽内存，默认4000万
+func PreviewMaxImagePixels() int64 {
+	return genv.GetVar("VPRIX_AGENT_PREVIEW_MAX_IMAGE_PIXELS", 40000000).Int64()
+}
+
+// ClipboardMaxSize 获取剪贴板同步的内容最大长度，单位字节，默认10MB
+func ClipboardMaxSize() int64 {
+	return genv.GetVar("VPRIX_AGENT_CLIPBOARD_MAX_SIZE", 10*1024*1024).Int64()
+}
+
+// ClipboardPollInterval 获取检查桌面剪贴板变化的间隔，单位毫秒，默认1秒
+func ClipboardPollInterval() int {
+	return genv.GetVar("VPRIX_AGENT_CLIPBOARD_POLL_INTERVAL", 1000).Int()
+}
+
+// AudioEnable 是否启动桌面的声音服务，默认打开
+func AudioEnable() bool {
+	return genv.GetVar("VPRIX_AGENT_AUDIO_ENABLE", true).Bool()
+}
+
+// AudioRuntimeDir 获取声音服务的运行目录，存放连接声音服务的unix socket
+func AudioRuntimeDir() string {
+	return genv.Get("VPRIX_AGENT_AUDIO_RUNTIME_DIR", "/tmp/vprix-pulse")
+}
+
+// AudioBitrate 获取opus编码的码率，单位bps，默认64000
+func AudioBitrate() int {
+	return genv.GetVar("VPRIX_AGENT_AUDIO_BITRATE", 64000).Int()
+}
+
+// MicJitterBuffer 获取麦克风开始写入桌面之前缓存的声音时长，单位毫秒，默认60
+func MicJitterBuffer() int {
+	return genv.GetVar("VPRIX_AGENT_MIC_JITTER_BUFFER", 60).Int()
+}
+
+// MicMaxLatency 获取麦克风最多缓存的声音时长，超过后丢弃最早的声音，单位毫秒，默认300
+func MicMaxLatency() int {
+	return genv.GetVar("VPRIX_AGENT_MIC_MAX_LATENCY", 300).Int()
+}
+
+// ExecAllowRoot 执行远程命令时是否允许以root身份执行，默认不允许
+// 设置VPRIX_AGENT_EXEC_ALLOW_ROOT=true后，拥有执行命令权限的用户可以通过user=root以root身份执行命令
+func ExecAllowRoot() bool {
+	return genv.GetVar("VPRIX_AGENT_EXEC_ALLOW_ROOT", false).Bool()
+}
+
+// ExecTimeout 获取执行远程命令的默认超时时间，单位秒，默认60
+func ExecTimeout() int {
+	return genv.GetVar("VPRIX_AGENT_EXEC_TIMEOUT", 60).Int()
+}
+
+// ExecMaxTimeout 获取执行远程命令允许设置的最长超时时间，单位秒，默认1小时
+func ExecMaxTimeout() int {
+	return genv.GetVar("VPRIX_AGENT_EXEC_MAX_TIMEOUT", 3600).Int()
+}
+
+// ExecMaxOutput 获取不使用流式输出时，stdout和stderr各自最多保留的长度，单位字节，默认10MB
+func ExecMaxOutput() int {
+	return genv.GetVar("VPRIX_AGENT_EXEC_MAX_OUTPUT", 10*1024*1024).Int()
+}
+
+// TerminalShell 获取网页终端使用的shell，不存在时使用/bin/sh
+func TerminalShell() string {
+	return genv.Get("VPRIX_AGENT_TERMINAL_SHELL", "/bin/bash")
+}
+
 // User 获取登录桌面的用户名
 func User() string {
 	return genv.Get("VPRIX_USER", "vprix-user")
@@ -7,5 +7,7 @@ require (
 	github.com/gogf/gf v1.16.9
 	github.com/osgochina/dmicro v0.6.2
 	github.com/vprix/vncproxy v1.1.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/net v0.0.0-20220517181318-183a9ca12b87
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 )
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/text/gstr"
+)
+
+// 支持的认证后端
+const (
+	BackendEnv      = "env"
+	BackendHtpasswd = "htpasswd"
+	BackendShadow   = "shadow"
+	BackendJWT      = "jwt"
+)
+
+// DefaultUid 认证后端无法提供uid时使用的默认值
+const DefaultUid = 1000
+
+// ErrInvalidCredential 用户名密码或token不正确
+var ErrInvalidCredential = gerror.New("用户名或密码错误")
+
+// Credential 登录时提交的凭证，密码类后端使用Username和Password，jwt后端使用Token
+type Credential struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Identity 认证成功后的用户身份
+type Identity struct {
+	Username string
+	Uid      int
+	Backend  string
+	// 后端指定的角色，为空表示由调用方决定
+	Role string
+}
+
+// Authenticator 认证后端
+type Authenticator interface {
+	// Name 后端名称
+	Name() string
+	// Authenticate 校验凭证，成功返回用户身份
+	Authenticate(credential *Credential) (*Identity, error)
+}
+
+// Chain 按顺序尝试多个认证后端，只要有一个认证成功即可
+type Chain []Authenticator
+
+var _ Authenticator = Chain{}
+
+func (that Chain) Name() string {
+	var names []string
+	for _, a := range that {
+		names = append(names, a.Name())
+	}
+	return gstr.Join(names, ",")
+}
+
+func (that Chain) Authenticate(credential *Credential) (*Identity, error) {
+	err := ErrInvalidCredential
+	for _, a := range that {
+		identity, e := a.Authenticate(credential)
+		if e == nil {
+			return identity, nil
+		}
+		err = e
+	}
+	return nil, err
+}
+
+// Options 创建认证后端需要的配置
+type Options struct {
+	// env后端使用的用户名密码
+	Username string
+	Password string
+	// htpasswd文件路径
+	HtpasswdFile string
+	// shadow文件路径，以及允许登录的桌面用户
+	ShadowFile  string
+	DesktopUser string
+	// jwt的签名密钥、签发者和接收者
+	JWTSecret   string
+	JWTIssuer   string
+	JWTAudience string
+}
+
+// New 根据后端名称创建认证后端，多个后端用逗号分隔，按顺序尝试
+func New(backends string, opts *Options) (Authenticator, error) {
+	var chain Chain
+	for _, name := range gstr.SplitAndTrim(backends, ",") {
+		switch name {
+		case BackendEnv:
+			chain = append(chain, NewEnvAuthenticator(opts.Username, opts.Password))
+		case BackendHtpasswd:
+			chain = append(chain, NewHtpasswdAuthenticator(opts.HtpasswdFile))
+		case BackendShadow:
+			shadow := NewShadowAuthenticator(opts.ShadowFile, opts.DesktopUser)
+			if err := shadow.Check(); err != nil {
+				return nil, err
+			}
+			chain = append(chain, shadow)
+		case BackendJWT:
+			if len(opts.JWTSecret) <= 0 {
+				return nil, gerror.New("jwt认证后端需要配置签名密钥")
+			}
+			chain = append(chain, NewJWTAuthenticator([]byte(opts.JWTSecret), opts.JWTIssuer, opts.JWTAudience))
+		default:
+			return nil, gerror.Newf("不支持的认证后端:%s", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, gerror.New("没有配置认证后端")
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
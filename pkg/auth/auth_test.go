@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gogf/gf/frame/g"
+	"github.com/gogf/gf/os/gfile"
+	"github.com/gogf/gf/test/gtest"
+	"github.com/gogf/gf/text/gstr"
+	"golang.org/x/crypto/bcrypt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 使用secret签发HS256的jwt
+func signJWT(secret string, header g.Map, claims g.Map) string {
+	headerBytes, _ := json.Marshal(header)
+	claimsBytes, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestEnvAuthenticator(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		a := NewEnvAuthenticator("vprix", "secret")
+		cases := []struct {
+			username string
+			password string
+			ok       bool
+		}{
+			{"vprix", "secret", true},
+			{"vprix", "wrong", false},
+			{"other", "secret", false},
+			{"vprix", "", false},
+			{"", "", false},
+		}
+		for _, c := range cases {
+			identity, err := a.Authenticate(&Credential{Username: c.username, Password: c.password})
+			if !c.ok {
+				t.Assert(err, ErrInvalidCredential)
+				continue
+			}
+			t.Assert(err, nil)
+			t.Assert(identity.Username, c.username)
+			t.Assert(identity.Backend, BackendEnv)
+		}
+	})
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		t.Assert(err, nil)
+		file := filepath.Join(gfile.TempDir(), fmt.Sprintf("vprix-htpasswd-%d", time.Now().UnixNano()))
+		defer gfile.Remove(file)
+		content := "# 注释\n" +
+			"vprix:" + string(hash) + "\n" +
+			"md5user:$apr1$salt$hash\n"
+		t.Assert(gfile.PutContents(file, content), nil)
+		a := NewHtpasswdAuthenticator(file)
+		cases := []struct {
+			username string
+			password string
+			ok       bool
+		}{
+			{"vprix", "secret", true},
+			{"vprix", "wrong", false},
+			{"nobody", "secret", false},
+			{"md5user", "secret", false},
+			{"vprix", "", false},
+		}
+		for _, c := range cases {
+			identity, err := a.Authenticate(&Credential{Username: c.username, Password: c.password})
+			if !c.ok {
+				t.AssertNE(err, nil)
+				continue
+			}
+			t.Assert(err, nil)
+			t.Assert(identity.Username, c.username)
+			t.Assert(identity.Backend, BackendHtpasswd)
+		}
+		// 文件不存在时返回错误
+		_, err = NewHtpasswdAuthenticator(file + ".missing").Authenticate(&Credential{Username: "vprix", Password: "secret"})
+		t.AssertNE(err, nil)
+	})
+}
+
+func TestShadowAuthenticator(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		file := filepath.Join(gfile.TempDir(), fmt.Sprintf("vprix-shadow-%d", time.Now().UnixNano()))
+		defer gfile.Remove(file)
+		content := "root:*:19000:0:99999:7:::\n" +
+			"vprix:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1:19000:0:99999:7:::\n" +
+			"yescrypt:$y$j9T$salt$hash:19000:0:99999:7:::\n" +
+			"locked:!$6$saltstring$hash:19000:0:99999:7:::\n"
+		t.Assert(gfile.PutContents(file, content), nil)
+
+		a := NewShadowAuthenticator(file, "vprix")
+		t.Assert(a.Check(), nil)
+		identity, err := a.Authenticate(&Credential{Username: "vprix", Password: "Hello world!"})
+		t.Assert(err, nil)
+		t.Assert(identity.Backend, BackendShadow)
+		_, err = a.Authenticate(&Credential{Username: "vprix", Password: "hello world!"})
+		t.Assert(err, ErrInvalidCredential)
+		// 只允许桌面用户登录
+		_, err = a.Authenticate(&Credential{Username: "root", Password: "Hello world!"})
+		t.Assert(err, ErrInvalidCredential)
+
+		// 不支持的hash算法、被锁定以及不存在的用户在创建后端时就返回错误
+		err = NewShadowAuthenticator(file, "yescrypt").Check()
+		t.AssertNE(err, nil)
+		t.Assert(gstr.Contains(err.Error(), "$y$"), true)
+		t.AssertNE(NewShadowAuthenticator(file, "locked").Check(), nil)
+		t.AssertNE(NewShadowAuthenticator(file, "nobody").Check(), nil)
+		_, err = New("shadow", &Options{ShadowFile: file, DesktopUser: "yescrypt"})
+		t.AssertNE(err, nil)
+		_, err = New("shadow", &Options{ShadowFile: file, DesktopUser: "vprix"})
+		t.Assert(err, nil)
+	})
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		secret := "jwt-secret"
+		a := NewJWTAuthenticator([]byte(secret), "vprix", "agent")
+		hs256 := g.Map{"alg": "HS256", "typ": "JWT"}
+		now := time.Now().Unix()
+		claims := func(extra g.Map) g.Map {
+			m := g.Map{"sub": "alice", "iss": "vprix", "aud": "agent", "exp": now + 60, "uid": 1001, "role": "viewer"}
+			for k, v := range extra {
+				m[k] = v
+			}
+			return m
+		}
+		valid := signJWT(secret, hs256, claims(nil))
+		// 修改声明但是保留原来的签名
+		parts := gstr.Split(valid, ".")
+		forged := gstr.Split(signJWT(secret, hs256, claims(g.Map{"role": "owner"})), ".")
+		tampered := parts[0] + "." + forged[1] + "." + parts[2]
+		cases := []struct {
+			name  string
+			token string
+			ok    bool
+		}{
+			{"valid", valid, true},
+			{"aud array", signJWT(secret, hs256, claims(g.Map{"aud": []string{"other", "agent"}})), true},
+			{"expired", signJWT(secret, hs256, claims(g.Map{"exp": now - 1})), false},
+			{"no exp", signJWT(secret, hs256, claims(g.Map{"exp": 0})), false},
+			{"not before", signJWT(secret, hs256, claims(g.Map{"nbf": now + 60})), false},
+			{"tampered", tampered, false},
+			{"wrong secret", signJWT("other-secret", hs256, claims(nil)), false},
+			{"alg none", signJWT(secret, g.Map{"alg": "none"}, claims(nil)), false},
+			{"wrong issuer", signJWT(secret, hs256, claims(g.Map{"iss": "other"})), false},
+			{"wrong audience", signJWT(secret, hs256, claims(g.Map{"aud": "other"})), false},
+			{"no subject", signJWT(secret, hs256, claims(g.Map{"sub": ""})), false},
+			{"malformed", parts[0] + "." + parts[1], false},
+			{"empty", "", false},
+		}
+		for _, c := range cases {
+			identity, err := a.Authenticate(&Credential{Token: c.token})
+			if !c.ok {
+				t.AssertNE(err, nil)
+				continue
+			}
+			t.Assert(err, nil)
+			t.Assert(identity.Username, "alice")
+			t.Assert(identity.Uid, 1001)
+			t.Assert(identity.Role, "viewer")
+			t.Assert(identity.Backend, BackendJWT)
+		}
+	})
+}
+
+func TestChain(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		a, err := New("env,jwt", &Options{Username: "vprix", Password: "secret", JWTSecret: "jwt-secret"})
+		t.Assert(err, nil)
+		t.Assert(a.Name(), "env,jwt")
+		// 第一个后端认证成功
+		identity, err := a.Authenticate(&Credential{Username: "vprix", Password: "secret"})
+		t.Assert(err, nil)
+		t.Assert(identity.Backend, BackendEnv)
+		// 第一个后端失败时尝试下一个
+		token := signJWT("jwt-secret", g.Map{"alg": "HS256"}, g.Map{"sub": "alice", "exp": time.Now().Unix() + 60})
+		identity, err = a.Authenticate(&Credential{Token: token})
+		t.Assert(err, nil)
+		t.Assert(identity.Backend, BackendJWT)
+		t.Assert(identity.Uid, DefaultUid)
+		// 所有后端都失败
+		_, err = a.Authenticate(&Credential{Username: "vprix", Password: "wrong"})
+		t.AssertNE(err, nil)
+
+		// 只有一个后端时不使用Chain
+		a, err = New("env", &Options{Username: "vprix", Password: "secret"})
+		t.Assert(err, nil)
+		t.Assert(a.Name(), BackendEnv)
+		_, err = New("jwt", &Options{})
+		t.AssertNE(err, nil)
+		_, err = New("ldap", &Options{})
+		t.AssertNE(err, nil)
+		_, err = New("", &Options{})
+		t.AssertNE(err, nil)
+	})
+}
@@ -0,0 +1,31 @@
+package auth
+
+import "crypto/subtle"
+
+// EnvAuthenticator 使用环境变量中配置的用户名密码认证
+type EnvAuthenticator struct {
+	username string
+	password string
+}
+
+var _ Authenticator = new(EnvAuthenticator)
+
+func NewEnvAuthenticator(username, password string) *EnvAuthenticator {
+	return &EnvAuthenticator{username: username, password: password}
+}
+
+func (that *EnvAuthenticator) Name() string {
+	return BackendEnv
+}
+
+func (that *EnvAuthenticator) Authenticate(credential *Credential) (*Identity, error) {
+	if len(credential.Username) <= 0 || len(credential.Password) <= 0 {
+		return nil, ErrInvalidCredential
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(credential.Username), []byte(that.username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(credential.Password), []byte(that.password)) == 1
+	if !userOk || !passOk {
+		return nil, ErrInvalidCredential
+	}
+	return &Identity{Username: credential.Username, Uid: DefaultUid, Backend: BackendEnv}, nil
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bufio"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/text/gstr"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+)
+
+// HtpasswdAuthenticator 使用htpasswd文件认证，只支持bcrypt格式的密码(htpasswd -B)
+// 每次认证都会重新读取文件，修改文件后无需重启agent
+type HtpasswdAuthenticator struct {
+	file string
+}
+
+var _ Authenticator = new(HtpasswdAuthenticator)
+
+func NewHtpasswdAuthenticator(file string) *HtpasswdAuthenticator {
+	return &HtpasswdAuthenticator{file: file}
+}
+
+func (that *HtpasswdAuthenticator) Name() string {
+	return BackendHtpasswd
+}
+
+// 从文件中查找用户的密码hash
+func (that *HtpasswdAuthenticator) lookup(username string) (string, error) {
+	f, err := os.Open(that.file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := gstr.Trim(scanner.Text())
+		if len(line) <= 0 || line[0] == '#' {
+			continue
+		}
+		pos := gstr.Pos(line, ":")
+		if pos <= 0 {
+			continue
+		}
+		if line[:pos] == username {
+			return line[pos+1:], nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrInvalidCredential
+}
+
+func (that *HtpasswdAuthenticator) Authenticate(credential *Credential) (*Identity, error) {
+	if len(credential.Username) <= 0 || len(credential.Password) <= 0 {
+		return nil, ErrInvalidCredential
+	}
+	hash, err := that.lookup(credential.Username)
+	if err != nil {
+		if err != ErrInvalidCredential {
+			return nil, gerror.Wrapf(err, "读取htpasswd文件[%s]失败", that.file)
+		}
+		return nil, err
+	}
+	if !gstr.HasPrefix(hash, "$2y$") && !gstr.HasPrefix(hash, "$2a$") && !gstr.HasPrefix(hash, "$2b$") {
+		return nil, gerror.Newf("用户[%s]的密码不是bcrypt格式", credential.Username)
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(credential.Password))
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+	return &Identity{Username: credential.Username, Uid: DefaultUid, Backend: BackendHtpasswd}, nil
+}
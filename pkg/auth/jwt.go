@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/text/gstr"
+	"time"
+)
+
+// JWTAuthenticator 校验管控平台签发的jwt，只支持HS256签名
+type JWTAuthenticator struct {
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+var _ Authenticator = new(JWTAuthenticator)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// JWTClaims jwt中使用到的字段，aud可以是字符串或者字符串数组
+type JWTClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Uid       int             `json:"uid"`
+	Role      string          `json:"role"`
+}
+
+// 判断aud中是否包含指定的接收者
+func (that *JWTClaims) hasAudience(audience string) bool {
+	var one string
+	if json.Unmarshal(that.Audience, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(that.Audience, &many) == nil {
+		for _, a := range many {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func NewJWTAuthenticator(secret []byte, issuer string, audience string) *JWTAuthenticator {
+	return &JWTAuthenticator{secret: secret, issuer: issuer, audience: audience}
+}
+
+func (that *JWTAuthenticator) Name() string {
+	return BackendJWT
+}
+
+// Parse 校验签名以及有效期，返回token中的声明
+func (that *JWTAuthenticator) Parse(token string) (*JWTClaims, error) {
+	parts := gstr.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, gerror.New("jwt格式错误")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, gerror.New("jwt格式错误")
+	}
+	header := new(jwtHeader)
+	if err = json.Unmarshal(headerBytes, header); err != nil {
+		return nil, gerror.New("jwt格式错误")
+	}
+	if header.Alg != "HS256" {
+		return nil, gerror.Newf("不支持的jwt签名算法:%s", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, gerror.New("jwt格式错误")
+	}
+	mac := hmac.New(sha256.New, that.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, gerror.New("jwt签名错误")
+	}
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, gerror.New("jwt格式错误")
+	}
+	claims := new(JWTClaims)
+	if err = json.Unmarshal(claimsBytes, claims); err != nil {
+		return nil, gerror.New("jwt格式错误")
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt <= 0 || now >= claims.ExpiresAt {
+		return nil, gerror.New("jwt已过期")
+	}
+	if claims.NotBefore > 0 && now < claims.NotBefore {
+		return nil, gerror.New("jwt尚未生效")
+	}
+	if len(that.issuer) > 0 && claims.Issuer != that.issuer {
+		return nil, gerror.New("jwt签发者不正确")
+	}
+	if len(that.audience) > 0 && !claims.hasAudience(that.audience) {
+		return nil, gerror.New("jwt接收者不正确")
+	}
+	if len(claims.Subject) <= 0 {
+		return nil, gerror.New("jwt缺少sub")
+	}
+	return claims, nil
+}
+
+func (that *JWTAuthenticator) Authenticate(credential *Credential) (*Identity, error) {
+	if len(credential.Token) <= 0 {
+		return nil, ErrInvalidCredential
+	}
+	claims, err := that.Parse(credential.Token)
+	if err != nil {
+		return nil, err
+	}
+	uid := claims.Uid
+	if uid <= 0 {
+		uid = DefaultUid
+	}
+	return &Identity{Username: claims.Subject, Uid: uid, Backend: BackendJWT, Role: claims.Role}, nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/text/gstr"
+	"hash"
+	"strconv"
+)
+
+// 实现glibc crypt(3)中的SHA-256($5$)和SHA-512($6$)算法，规范见 https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+	shaCryptSaltMax       = 16
+)
+
+// sha256输出时的字节顺序
+var sha256CryptOrder = [][3]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+}
+
+// sha512输出时的字节顺序
+var sha512CryptOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// ShaCryptVerify 校验密码与$5$或$6$格式的hash是否匹配
+func ShaCryptVerify(hashed string, password string) (bool, error) {
+	result, err := ShaCrypt(hashed, password)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(result), []byte(hashed)) == 1, nil
+}
+
+// ShaCrypt 使用setting中的算法、轮数和盐计算密码的hash，setting可以是完整的hash
+func ShaCrypt(setting string, password string) (string, error) {
+	var (
+		newHash func() hash.Hash
+		magic   string
+		order   [][3]int
+	)
+	switch {
+	case gstr.HasPrefix(setting, "$5$"):
+		newHash, magic, order = sha256.New, "$5$", sha256CryptOrder
+	case gstr.HasPrefix(setting, "$6$"):
+		newHash, magic, order = sha512.New, "$6$", sha512CryptOrder
+	default:
+		return "", gerror.New("不支持的密码hash算法")
+	}
+	rest := setting[len(magic):]
+	rounds := shaCryptRoundsDefault
+	roundsCustom := false
+	if gstr.HasPrefix(rest, "rounds=") {
+		pos := gstr.Pos(rest, "$")
+		if pos < 0 {
+			return "", gerror.New("密码hash格式错误")
+		}
+		n, err := strconv.ParseUint(rest[len("rounds="):pos], 10, 32)
+		if err != nil {
+			return "", gerror.New("密码hash格式错误")
+		}
+		rounds = int(n)
+		if rounds < shaCryptRoundsMin {
+			rounds = shaCryptRoundsMin
+		}
+		if rounds > shaCryptRoundsMax {
+			rounds = shaCryptRoundsMax
+		}
+		roundsCustom = true
+		rest = rest[pos+1:]
+	}
+	salt := rest
+	if pos := gstr.Pos(salt, "$"); pos >= 0 {
+		salt = salt[:pos]
+	}
+	if len(salt) > shaCryptSaltMax {
+		salt = salt[:shaCryptSaltMax]
+	}
+	sum := shaCryptSum(newHash, []byte(password), []byte(salt), rounds)
+
+	out := []byte(magic)
+	if roundsCustom {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt...)
+	out = append(out, '$')
+	for _, o := range order {
+		out = shaCryptEncode(out, sum[o[0]], sum[o[1]], sum[o[2]], 4)
+	}
+	if len(sum) == sha256.Size {
+		out = shaCryptEncode(out, 0, sum[31], sum[30], 3)
+	} else {
+		out = shaCryptEncode(out, 0, 0, sum[63], 2)
+	}
+	return string(out), nil
+}
+
+// 计算摘要
+func shaCryptSum(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	h := newHash()
+	size := h.Size()
+
+	// 摘要B = H(密码+盐+密码)
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	// 摘要A
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	i := len(password)
+	for ; i > size; i -= size {
+		h.Write(b)
+	}
+	h.Write(b[:i])
+	for i = len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// 序列P
+	h.Reset()
+	for i = 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	dp := h.Sum(nil)
+	p := make([]byte, 0, len(password))
+	for i = len(password); i > size; i -= size {
+		p = append(p, dp...)
+	}
+	p = append(p, dp[:i]...)
+
+	// 序列S
+	h.Reset()
+	for i = 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	ds := h.Sum(nil)
+	s := make([]byte, 0, len(salt))
+	for i = len(salt); i > size; i -= size {
+		s = append(s, ds...)
+	}
+	s = append(s, ds[:i]...)
+
+	// 多轮迭代
+	for i = 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(a)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(a)
+		} else {
+			h.Write(p)
+		}
+		a = h.Sum(a[:0])
+	}
+	return a
+}
+
+// 把3个字节编码为n个字符
+func shaCryptEncode(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, shaCryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"testing"
+)
+
+func TestShaCrypt(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		// 测试用例与 openssl passwd -5/-6 以及 glibc crypt(3) 的结果一致
+		cases := [][3]string{
+			{"$5$saltstring", "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+			{"$5$rounds=10000$saltstringsaltstring", "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+			{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+			{"$6$rounds=10000$saltstringsaltstring", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		}
+		for _, c := range cases {
+			result, err := ShaCrypt(c[0], c[1])
+			t.Assert(err, nil)
+			t.Assert(result, c[2])
+			ok, err := ShaCryptVerify(c[2], c[1])
+			t.Assert(err, nil)
+			t.Assert(ok, true)
+			ok, err = ShaCryptVerify(c[2], "hello world!")
+			t.Assert(err, nil)
+			t.Assert(ok, false)
+		}
+		_, err := ShaCrypt("$1$saltstring", "Hello world!")
+		t.AssertNE(err, nil)
+	})
+}
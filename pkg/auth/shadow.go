@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"bufio"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/text/gstr"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// ShadowAuthenticator 使用/etc/shadow中桌面用户的密码认证，只允许桌面用户登录
+type ShadowAuthenticator struct {
+	file        string
+	desktopUser string
+}
+
+var _ Authenticator = new(ShadowAuthenticator)
+
+func NewShadowAuthenticator(file string, desktopUser string) *ShadowAuthenticator {
+	if len(file) <= 0 {
+		file = "/etc/shadow"
+	}
+	return &ShadowAuthenticator{file: file, desktopUser: desktopUser}
+}
+
+func (that *ShadowAuthenticator) Name() string {
+	return BackendShadow
+}
+
+// 从shadow文件中查找用户的密码hash
+func (that *ShadowAuthenticator) lookup(username string) (string, error) {
+	f, err := os.Open(that.file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := gstr.Split(scanner.Text(), ":")
+		if len(fields) < 2 || fields[0] != username {
+			continue
+		}
+		return fields[1], nil
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrInvalidCredential
+}
+
+// 判断hash是否是空密码、被锁定或者禁止密码登录的账号
+func shadowLocked(hash string) bool {
+	return len(hash) <= 0 || hash[0] == '!' || hash[0] == '*'
+}
+
+// 检查hash是否是支持的算法，目前只支持SHA-256($5$)和SHA-512($6$)
+func checkShadowHash(username string, hash string) error {
+	if gstr.HasPrefix(hash, "$5$") || gstr.HasPrefix(hash, "$6$") {
+		return nil
+	}
+	// 不带$前缀的是传统的DES格式
+	algorithm := "DES"
+	if pos := gstr.Pos(hash[1:], "$"); hash[0] == '$' && pos >= 0 {
+		algorithm = hash[:pos+2]
+	}
+	return gerror.Newf("用户[%s]的密码使用了不支持的hash算法[%s]，shadow认证后端只支持SHA-256($5$)和SHA-512($6$)，"+
+		"请使用 chpasswd -c SHA512 重新设置密码", username, algorithm)
+}
+
+// Check 检查桌面用户的密码是否可以用于登录，在创建认证后端时调用，避免到登录时才发现不支持的hash算法
+func (that *ShadowAuthenticator) Check() error {
+	hash, err := that.lookup(that.desktopUser)
+	if err != nil {
+		if err == ErrInvalidCredential {
+			return gerror.Newf("shadow文件[%s]中没有用户[%s]", that.file, that.desktopUser)
+		}
+		return gerror.Wrapf(err, "读取shadow文件[%s]失败", that.file)
+	}
+	if shadowLocked(hash) {
+		return gerror.Newf("用户[%s]没有设置密码或者已被锁定，无法使用shadow认证后端", that.desktopUser)
+	}
+	return checkShadowHash(that.desktopUser, hash)
+}
+
+func (that *ShadowAuthenticator) Authenticate(credential *Credential) (*Identity, error) {
+	if len(credential.Username) <= 0 || len(credential.Password) <= 0 {
+		return nil, ErrInvalidCredential
+	}
+	if credential.Username != that.desktopUser {
+		return nil, ErrInvalidCredential
+	}
+	hash, err := that.lookup(credential.Username)
+	if err != nil {
+		if err != ErrInvalidCredential {
+			return nil, gerror.Wrapf(err, "读取shadow文件[%s]失败", that.file)
+		}
+		return nil, err
+	}
+	// 空密码、被锁定或者禁止密码登录的账号都不允许登录
+	if shadowLocked(hash) {
+		return nil, ErrInvalidCredential
+	}
+	if err = checkShadowHash(credential.Username, hash); err != nil {
+		return nil, err
+	}
+	ok, err := ShaCryptVerify(hash, credential.Password)
+	if err != nil {
+		return nil, gerror.Wrapf(err, "用户[%s]", credential.Username)
+	}
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+	identity := &Identity{Username: credential.Username, Uid: DefaultUid, Backend: BackendShadow}
+	if u, e := user.Lookup(credential.Username); e == nil {
+		if uid, e := strconv.Atoi(u.Uid); e == nil {
+			identity.Uid = uid
+		}
+	}
+	return identity, nil
+}
@@ -2,7 +2,9 @@ package customexec
 
 import (
 	"agent/env"
+	"github.com/gogf/gf/os/genv"
 	"github.com/osgochina/dmicro/logger"
+	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
@@ -22,7 +24,9 @@ func Command(name string, arg ...string) *Cmd {
 	return c
 }
 
-func (that *Cmd) SetUser(username ...string) {
+// SetUser 设置以指定的用户身份运行，默认为桌面用户，格式为 用户名[:用户组]
+// 查找用户失败时返回错误，此时没有设置身份，调用方不能继续以当前身份(通常是root)执行命令
+func (that *Cmd) SetUser(username ...string) error {
 	userName := env.User()
 	if len(username) > 0 && len(username[0]) > 0 {
 		userName = username[0]
@@ -37,33 +41,77 @@ func (that *Cmd) SetUser(username ...string) {
 	u, err := user.Lookup(userName)
 	if err != nil {
 		logger.Error(err)
-		return
+		return err
 	}
 	uid, err := strconv.ParseUint(u.Uid, 10, 32)
 	if err != nil {
 		logger.Error(err)
-		return
+		return err
 	}
 	gid, err := strconv.ParseUint(u.Gid, 10, 32)
 	if err != nil && groupName == "" {
 		logger.Error(err)
-		return
+		return err
 	}
 	if groupName != "" {
 		g, err := user.LookupGroup(groupName)
 		if err != nil {
 			logger.Error(err)
-			return
+			return err
 		}
 		gid, err = strconv.ParseUint(g.Gid, 10, 32)
 		if err != nil {
 			logger.Error(err)
-			return
+			return err
 		}
 	}
-	that.Cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), NoSetGroups: true}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), NoSetGroups: true}
+	// 以root运行时必须把附加组换成目标用户的附加组，否则子进程会继承root的附加组(如docker、disk等)
+	// 非root运行时没有权限调用setgroups，子进程本来就只有当前用户的附加组
+	if os.Geteuid() == 0 {
+		credential.NoSetGroups = false
+		credential.Groups = []uint32{uint32(gid)}
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			logger.Warningf("获取用户[%s]的附加组失败，只使用主组:%v", userName, err)
+		}
+		for _, id := range groupIds {
+			if g, e := strconv.ParseUint(id, 10, 32); e == nil && uint32(g) != uint32(gid) {
+				credential.Groups = append(credential.Groups, uint32(g))
+			}
+		}
+	}
+	that.Cmd.SysProcAttr.Credential = credential
+	return nil
 }
 
 func (that *Cmd) Start() error {
 	return that.Cmd.Start()
 }
+
+// 传给子进程的环境变量，agent自己的配置(登录密码、签名密钥等)不能传给子进程
+var passEnvKeys = []string{"DISPLAY", "LANG", "LC_ALL", "TZ", "XAUTHORITY", "PULSE_SERVER"}
+
+// 没有设置PATH时使用的默认值
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// UserEnv 生成以username身份运行的子进程使用的最小环境变量
+// 只包含HOME、USER、LOGNAME、PATH，以及显示、语言、声音服务相关的变量，extra追加在最后
+func UserEnv(username string, extra ...string) []string {
+	home := env.Home()
+	if u, err := user.Lookup(username); err == nil && len(u.HomeDir) > 0 {
+		home = u.HomeDir
+	}
+	envs := []string{
+		"HOME=" + home,
+		"USER=" + username,
+		"LOGNAME=" + username,
+		"PATH=" + genv.Get("PATH", defaultPath),
+	}
+	for _, key := range passEnvKeys {
+		if value := genv.Get(key); len(value) > 0 {
+			envs = append(envs, key+"="+value)
+		}
+	}
+	return append(envs, extra...)
+}
@@ -0,0 +1,179 @@
+package desktop
+
+import (
+	"agent/pkg/customexec"
+	"fmt"
+	"github.com/gogf/gf/errors/gerror"
+	"github.com/gogf/gf/text/gstr"
+	"github.com/gogf/gf/util/gconv"
+	"github.com/osgochina/dmicro/logger"
+	"github.com/osgochina/dmicro/supervisor/process"
+)
+
+// 桌面中的扬声器，是一个null sink，浏览器通过它的monitor获取桌面的声音
+const PulseSpeakerSink = "vprix_speaker"
+
+// 桌面中的麦克风，是一个从管道读取声音的source，浏览器的声音写入这个管道
+const PulseMicSource = "vprix_mic"
+
+// 麦克风的采样参数，写入管道的pcm格式为s16le
+const (
+	MicSampleRate = 48000
+	MicChannels   = 1
+)
+
+// 传给浏览器的声音的采样参数，pcm格式为s16le
+const (
+	AudioSampleRate = 48000
+	AudioChannels   = 2
+)
+
+// 声音的编码格式
+const (
+	AudioCodecOpus = "opus"
+	AudioCodecPCM  = "pcm"
+)
+
+// opus编码时使用的封装格式
+const (
+	AudioContainerWebm = "webm"
+	AudioContainerOgg  = "ogg"
+)
+
+// PulseAudio 桌面的声音服务
+// 不加载系统默认的配置，只通过unix socket提供服务，桌面中的程序通过PULSE_SERVER环境变量连接
+type PulseAudio struct {
+	user       string
+	runtimeDir string
+	logPath    string
+}
+
+func NewPulseAudio(runtimeDir string) *PulseAudio {
+	return &PulseAudio{runtimeDir: runtimeDir}
+}
+
+func (that *PulseAudio) User() string {
+	return that.user
+}
+
+func (that *PulseAudio) SetUser(user string) {
+	that.user = user
+}
+
+func (that *PulseAudio) RuntimeDir() string {
+	return that.runtimeDir
+}
+
+func (that *PulseAudio) LogPath() string {
+	return that.logPath
+}
+
+func (that *PulseAudio) SetLogPath(logPath string) {
+	that.logPath = logPath
+}
+
+// Server 连接声音服务的地址，作为PULSE_SERVER环境变量的值
+func (that *PulseAudio) Server() string {
+	return fmt.Sprintf("unix:%s/native", that.runtimeDir)
+}
+
+// MicPipe 麦克风读取声音的管道，由声音服务创建
+func (that *PulseAudio) MicPipe() string {
+	return fmt.Sprintf("%s/mic.fifo", that.runtimeDir)
+}
+
+// NewProcess 创建声音服务的进程
+func (that *PulseAudio) NewProcess() (*process.ProcEntry, error) {
+	if len(that.runtimeDir) == 0 {
+		return nil, gerror.New("声音服务的运行目录不能为空")
+	}
+	proc := process.NewProcEntry("/usr/bin/pulseaudio")
+	proc.SetArgs([]string{
+		"--daemonize=no",
+		"--exit-idle-time=-1",
+		"--disallow-exit",
+		"--log-target=stderr",
+		"-n",
+		"-L", fmt.Sprintf("module-native-protocol-unix socket=%s/native auth-anonymous=1", that.runtimeDir),
+		"-L", fmt.Sprintf("module-null-sink sink_name=%s rate=%d channels=%d sink_properties=device.description=Vprix-Speaker",
+			PulseSpeakerSink, AudioSampleRate, AudioChannels),
+		"-L", fmt.Sprintf("module-pipe-source source_name=%s file=%s format=s16le rate=%d channels=%d source_properties=device.description=Vprix-Microphone",
+			PulseMicSource, that.MicPipe(), MicSampleRate, MicChannels),
+	})
+	proc.SetDirectory(that.runtimeDir)
+	proc.SetUser(that.user)
+	proc.SetAutoReStart("true")
+	proc.SetRedirectStderr(true)
+	if len(that.logPath) > 0 {
+		proc.SetStdoutLogfile(that.logPath)
+		proc.SetStdoutLogFileMaxBytes("10MB")
+	}
+	proc.SetEnvironment(customexec.UserEnv(that.user, fmt.Sprintf("PULSE_RUNTIME_PATH=%s", that.runtimeDir)))
+	logger.Info("启动pulseaudio命令: ", "/usr/bin/pulseaudio ", gstr.Implode(" ", proc.Args()))
+	return proc, nil
+}
+
+// RecordCommand 创建以桌面用户身份录制扬声器声音的命令，编码之后的数据从标准输出读取
+// pcm格式直接输出s16le的原始数据，opus格式通过ffmpeg编码并封装为webm或ogg
+func (that *PulseAudio) RecordCommand(codec string, container string, bitrate int) (*customexec.Cmd, error) {
+	monitor := PulseSpeakerSink + ".monitor"
+	var cmd *customexec.Cmd
+	switch codec {
+	case AudioCodecPCM:
+		cmd = customexec.Command("/usr/bin/parec",
+			"--server="+that.Server(),
+			"--device="+monitor,
+			"--format=s16le",
+			"--rate="+gconv.String(AudioSampleRate),
+			"--channels="+gconv.String(AudioChannels),
+			"--latency-msec=20",
+			"--raw",
+		)
+	case AudioCodecOpus:
+		args := []string{
+			"-hide_banner", "-loglevel", "error", "-nostdin",
+			"-f", "pulse", "-server", that.Server(),
+			"-sample_rate", gconv.String(AudioSampleRate), "-channels", gconv.String(AudioChannels),
+			"-fragment_size", "3840", "-i", monitor,
+			"-c:a", "libopus", "-b:a", gconv.String(bitrate), "-application", "audio", "-frame_duration", "20",
+			"-flush_packets", "1",
+		}
+		// 缩短每个cluster和page的时长，降低浏览器端的延迟
+		switch container {
+		case AudioContainerWebm:
+			args = append(args, "-f", "webm", "-live", "1", "-cluster_time_limit", "100")
+		case AudioContainerOgg:
+			args = append(args, "-f", "ogg", "-page_duration", "20000")
+		default:
+			return nil, gerror.Newf("不支持的封装格式:%s", container)
+		}
+		cmd = customexec.Command("/usr/bin/ffmpeg", append(args, "pipe:1")...)
+	default:
+		return nil, gerror.Newf("不支持的编码格式:%s", codec)
+	}
+	cmd.Env = customexec.UserEnv(that.user)
+	if err := cmd.SetUser(that.user); err != nil {
+		return nil, gerror.Wrapf(err, "切换到用户[%s]失败", that.user)
+	}
+	return cmd, nil
+}
+
+// DecodeCommand 创建把浏览器录制的webm或ogg封装的声音解码为麦克风pcm格式的命令，从标准输入写入，标准输出读取
+func (that *PulseAudio) DecodeCommand(container string) (*customexec.Cmd, error) {
+	switch container {
+	case AudioContainerWebm, AudioContainerOgg:
+	default:
+		return nil, gerror.Newf("不支持的封装格式:%s", container)
+	}
+	cmd := customexec.Command("/usr/bin/ffmpeg",
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-f", container, "-i", "pipe:0",
+		"-f", "s16le", "-ar", gconv.String(MicSampleRate), "-ac", gconv.String(MicChannels),
+		"-flush_packets", "1", "pipe:1",
+	)
+	cmd.Env = customexec.UserEnv(that.user)
+	if err := cmd.SetUser(that.user); err != nil {
+		return nil, gerror.Wrapf(err, "切换到用户[%s]失败", that.user)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,123 @@
+package desktop
+
+import (
+	"agent/env"
+	"agent/pkg/customexec"
+	"bytes"
+	"fmt"
+	"github.com/gogf/gf/text/gstr"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// 命令说明 https://github.com/astrand/xclip
+
+// 剪贴板的选区
+const (
+	SelectionClipboard = "clipboard"
+	SelectionPrimary   = "primary"
+)
+
+// 常用的剪贴板内容类型
+const (
+	TargetUTF8 = "UTF8_STRING"
+	TargetPNG  = "image/png"
+)
+
+// xclip等待选区所有者响应的最长时间，应用卡住时避免接口一直阻塞
+const xclipTimeout = 3 * time.Second
+
+type XClip struct {
+	path string
+}
+
+func NewXClip() *XClip {
+	return &XClip{path: "/usr/bin/xclip"}
+}
+
+// 创建以桌面用户身份运行的xclip命令，无法切换到桌面用户时返回错误
+func (that *XClip) command(args ...string) (*customexec.Cmd, error) {
+	cmd := customexec.Command(that.path, args...)
+	cmd.Env = customexec.UserEnv(env.User())
+	if err := cmd.SetUser(); err != nil {
+		return nil, fmt.Errorf("切换到桌面用户失败:%v", err)
+	}
+	return cmd, nil
+}
+
+// Targets 获取选区当前支持的内容类型，选区为空时返回空列表
+func (that *XClip) Targets(selection string) ([]string, error) {
+	data, err := that.Read(selection, "TARGETS", 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	return gstr.SplitAndTrim(string(data), "\n"), nil
+}
+
+// Read 读取选区中指定类型的内容，超过limit字节时返回错误
+func (that *XClip) Read(selection string, target string, limit int64) ([]byte, error) {
+	cmd, err := that.command("-selection", selection, "-o", "-t", target)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(xclipTimeout, func() {
+		_ = cmd.Process.Kill()
+	})
+	defer timer.Stop()
+	data, err := ioutil.ReadAll(io.LimitReader(stdout, limit+1))
+	if int64(len(data)) > limit {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, fmt.Errorf("剪贴板内容超过%d字节", limit)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+	if err = cmd.Wait(); err != nil {
+		// 选区为空或者不支持该类型时xclip返回错误，当作没有内容
+		if gstr.Contains(stderr.String(), "not available") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("读取剪贴板失败:%v %s", err, gstr.Trim(stderr.String()))
+	}
+	return data, nil
+}
+
+// Write 把内容写入选区
+// xclip会在后台保持运行，直到其他程序占用该选区，所以这里不能等待它的输出
+func (that *XClip) Write(selection string, target string, data []byte) error {
+	cmd, err := that.command("-selection", selection, "-i", "-t", target)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = bytes.NewReader(data)
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("写入剪贴板失败:%v", err)
+		}
+		return nil
+	case <-time.After(xclipTimeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("写入剪贴板超时")
+	}
+}
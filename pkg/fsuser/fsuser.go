@@ -0,0 +1,130 @@
+// Package fsuser 以指定用户的身份执行文件操作
+//
+// agent以root身份运行，直接创建的文件属于root，并且会绕过用户自己的文件权限。
+// 这里在锁定的系统线程上通过setfsuid/setfsgid/setgroups切换文件系统身份，
+// 这几个系统调用只影响当前线程，不会影响agent的其他goroutine。
+package fsuser
+
+import (
+	"github.com/gogf/gf/errors/gerror"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Credential 执行文件操作使用的用户身份
+type Credential struct {
+	Uid    int
+	Gid    int
+	Groups []int
+}
+
+// Lookup 根据用户名查找身份，用户名可以是 user:group 的形式，与customexec.Cmd.SetUser一致
+func Lookup(username string) (*Credential, error) {
+	groupName := ""
+	if pos := strings.Index(username, ":"); pos != -1 {
+		groupName = username[pos+1:]
+		username = username[:pos]
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	if groupName != "" {
+		g, e := user.LookupGroup(groupName)
+		if e != nil {
+			return nil, e
+		}
+		if gid, e = strconv.Atoi(g.Gid); e != nil {
+			return nil, e
+		}
+	}
+	cred := &Credential{Uid: uid, Gid: gid}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range groupIds {
+		if g, e := strconv.Atoi(id); e == nil {
+			cred.Groups = append(cred.Groups, g)
+		}
+	}
+	return cred, nil
+}
+
+// 设置当前线程的fsuid，返回设置之后的fsuid
+// setfsuid不会返回错误，只能通过再次调用获取当前值来判断是否设置成功
+func setfsuid(uid int) int {
+	_, _, _ = syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	cur, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, ^uintptr(0), 0, 0)
+	return int(cur)
+}
+
+// 设置当前线程的fsgid，返回设置之后的fsgid
+func setfsgid(gid int) int {
+	_, _, _ = syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	cur, _, _ := syscall.RawSyscall(syscall.SYS_SETFSGID, ^uintptr(0), 0, 0)
+	return int(cur)
+}
+
+// 只设置当前线程的附加组，syscall.Setgroups会修改所有线程，不能使用
+func setgroups(groups []int) error {
+	list := make([]uint32, len(groups))
+	for i, g := range groups {
+		list[i] = uint32(g)
+	}
+	var p unsafe.Pointer
+	if len(list) > 0 {
+		p = unsafe.Pointer(&list[0])
+	}
+	_, _, e := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(len(list)), uintptr(p), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// Do 以该身份执行fn，fn中打开的文件在fn返回之后仍然可以以原来的身份继续读写
+// agent不是以root运行时无法切换身份，直接执行fn
+func (that *Credential) Do(fn func() error) error {
+	if os.Geteuid() != 0 {
+		return fn()
+	}
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	restored := false
+	defer func() {
+		// 没能恢复成root的线程不再交还给调度器，goroutine结束时线程随之退出
+		if restored {
+			runtime.UnlockOSThread()
+		}
+	}()
+	defer func() {
+		restored = setfsuid(0) == 0 && setfsgid(0) == 0 && setgroups(groups) == nil
+	}()
+	if err = setgroups(that.Groups); err != nil {
+		return gerror.Wrap(err, "切换用户组失败")
+	}
+	if setfsgid(that.Gid) != that.Gid {
+		return gerror.New("切换用户组失败")
+	}
+	if setfsuid(that.Uid) != that.Uid {
+		return gerror.New("切换用户失败")
+	}
+	return fn()
+}
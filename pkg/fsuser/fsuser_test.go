@@ -0,0 +1,45 @@
+package fsuser
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCredential_Do(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("需要以root运行")
+	}
+	gtest.C(t, func(t *gtest.T) {
+		cred, err := Lookup("nobody")
+		t.Assert(err, nil)
+		dir, err := ioutil.TempDir("", "fsuser")
+		t.Assert(err, nil)
+		defer os.RemoveAll(dir)
+		t.Assert(os.Chmod(dir, 0777), nil)
+		private := filepath.Join(dir, "private")
+		t.Assert(os.Mkdir(private, 0700), nil)
+
+		// 以nobody创建的文件属于nobody，并且无法访问root的私有目录
+		file := filepath.Join(dir, "file")
+		err = cred.Do(func() error {
+			if _, e := ioutil.ReadDir(private); e == nil {
+				t.Error("nobody不应该能读取root的私有目录")
+			}
+			return ioutil.WriteFile(file, []byte("x"), 0644)
+		})
+		t.Assert(err, nil)
+		info, err := os.Stat(file)
+		t.Assert(err, nil)
+		st := info.Sys().(*syscall.Stat_t)
+		t.Assert(int(st.Uid), cred.Uid)
+		t.Assert(int(st.Gid), cred.Gid)
+
+		// 执行完之后恢复为root
+		_, err = ioutil.ReadDir(private)
+		t.Assert(err, nil)
+	})
+}
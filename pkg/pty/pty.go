@@ -0,0 +1,80 @@
+// Package pty 打开伪终端并设置窗口大小
+//
+// 只使用标准库的系统调用，通过/dev/ptmx分配伪终端。ioctl通过RawConn执行，
+// 不会把主设备切换为阻塞模式，关闭主设备时正在进行的读取可以立即返回。
+package pty
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Winsize 终端的窗口大小
+type Winsize struct {
+	Rows uint16
+	Cols uint16
+	// 像素大小，一般不需要设置
+	X uint16
+	Y uint16
+}
+
+// 在文件上执行ioctl
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Open 打开一对伪终端，返回主设备和从设备，从设备作为子进程的标准输入输出
+func Open() (ptmx *os.File, tty *os.File, err error) {
+	ptmx, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = ptmx.Close()
+		}
+	}()
+	var unlock int32
+	if err = ioctl(ptmx, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		return nil, nil, fmt.Errorf("解锁伪终端失败:%v", err)
+	}
+	var n uint32
+	if err = ioctl(ptmx, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		return nil, nil, fmt.Errorf("获取伪终端编号失败:%v", err)
+	}
+	tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
+
+// Setsize 设置终端的窗口大小，前台进程会收到SIGWINCH
+func Setsize(f *os.File, size *Winsize) error {
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(size))
+}
+
+// Getsize 获取终端的窗口大小
+func Getsize(f *os.File) (*Winsize, error) {
+	size := new(Winsize)
+	if err := ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(size)); err != nil {
+		return nil, err
+	}
+	return size, nil
+}
@@ -0,0 +1,35 @@
+package pty
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"io"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		ptmx, tty, err := Open()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ptmx.Close()
+		t.Assert(Setsize(ptmx, &Winsize{Rows: 24, Cols: 80}), nil)
+		size, err := Getsize(tty)
+		t.Assert(err, nil)
+		t.Assert(size.Rows, 24)
+		t.Assert(size.Cols, 80)
+
+		// 子进程在伪终端中运行，能看到设置的窗口大小
+		cmd := exec.Command("/bin/sh", "-c", "stty size")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		t.Assert(cmd.Start(), nil)
+		_ = tty.Close()
+		data, _ := io.ReadAll(ptmx)
+		t.Assert(cmd.Wait(), nil)
+		t.Assert(string(data), "24 80\r\n")
+	})
+}
@@ -0,0 +1,406 @@
+// Package safepath 把客户端传入的路径限制在指定的根目录中
+//
+// agent以root身份运行，桌面用户可以在根目录中随意创建软链接，
+// 所以不能只做字符串比较，需要解析软链接之后按路径的每一级比较，
+// 打开文件时从根目录的fd开始逐级openat，并且每一级都不跟随软链接，
+// 防止校验之后、打开之前路径中的某一级被替换成指向根目录之外的软链接。
+// 重命名、删除、复制同样从父目录的fd开始通过renameat、unlinkat等操作，并且不跟随最后一级的软链接。
+package safepath
+
+import (
+	"github.com/gogf/gf/errors/gerror"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrEscape 路径不在根目录中
+var ErrEscape = gerror.New("path not found")
+
+// Within 判断path是否是root本身或者在root中，按路径的每一级比较，/home/u/Downloads-evil不在/home/u/Downloads中
+func Within(root string, path string) bool {
+	root = filepath.Clean(root)
+	path = filepath.Clean(path)
+	if path == root {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimRight(root, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
+// 解析路径中已经存在的部分的软链接，不存在的部分原样拼接在后面
+// 存在但是解析失败的软链接(例如指向不存在的文件)返回错误，避免通过它在其他位置创建文件
+func evalExisting(path string) (string, error) {
+	path = filepath.Clean(path)
+	var rest []string
+	for {
+		_, err := os.Lstat(path)
+		if err == nil {
+			real, e := filepath.EvalSymlinks(path)
+			if e != nil {
+				return "", e
+			}
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// EvalRoot 获取根目录解析软链接之后的绝对路径，根目录可以不存在
+// 其他函数的root参数都必须是EvalRoot的返回值
+func EvalRoot(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return evalExisting(abs)
+}
+
+// Resolve 把相对于root的路径转换为解析软链接之后的绝对路径
+// 路径本身或者解析软链接之后不在root中时返回ErrEscape，路径末尾不存在的部分原样保留，方便创建文件
+func Resolve(root string, name string) (string, error) {
+	joined := filepath.Join(root, filepath.FromSlash(name))
+	if !Within(root, joined) {
+		return "", ErrEscape
+	}
+	real, err := evalExisting(joined)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrEscape
+		}
+		return "", err
+	}
+	if !Within(root, real) {
+		return "", ErrEscape
+	}
+	return real, nil
+}
+
+// Rel 把root中的绝对路径转换为返回给客户端的路径，以/开头
+func Rel(root string, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || !Within(root, path) {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// 把root中的路径拆分为每一级的名称
+func components(root string, path string) []string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return nil
+	}
+	return strings.Split(rel, string(os.PathSeparator))
+}
+
+// 打开根目录
+func openRoot(root string) (int, error) {
+	fd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	return fd, nil
+}
+
+// 从dirfd开始逐级打开目录，每一级都不跟随软链接，create为true时创建不存在的目录
+// 成功时dirfd被关闭，返回最后一级目录的fd
+func walkDirs(dirfd int, path string, names []string, create bool, perm os.FileMode) (int, error) {
+	for _, name := range names {
+		fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err == syscall.ENOENT && create {
+			err = syscall.Mkdirat(dirfd, name, uint32(perm.Perm()))
+			if err == nil || err == syscall.EEXIST {
+				fd, err = syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+			}
+		}
+		_ = syscall.Close(dirfd)
+		if err != nil {
+			return -1, &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+		dirfd = fd
+	}
+	return dirfd, nil
+}
+
+// OpenFile 打开root中的文件，参数与os.OpenFile相同
+// 先用Resolve解析出真实路径，然后从root的fd开始逐级openat，任何一级在这期间被替换成软链接都会打开失败
+func OpenFile(root string, name string, flag int, perm os.FileMode) (*os.File, error) {
+	real, err := Resolve(root, name)
+	if err != nil {
+		return nil, err
+	}
+	dirfd, err := openRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	names := components(root, real)
+	if len(names) == 0 {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+			_ = syscall.Close(dirfd)
+			return nil, &os.PathError{Op: "open", Path: root, Err: syscall.EISDIR}
+		}
+		return os.NewFile(uintptr(dirfd), root), nil
+	}
+	dirfd, err = walkDirs(dirfd, real, names[:len(names)-1], false, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Openat(dirfd, names[len(names)-1], flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	_ = syscall.Close(dirfd)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: real, Err: err}
+	}
+	return os.NewFile(uintptr(fd), real), nil
+}
+
+// Open 以只读方式打开root中的文件
+func Open(root string, name string) (*os.File, error) {
+	return OpenFile(root, name, os.O_RDONLY, 0)
+}
+
+// MkdirAll 在root中创建目录，父目录不存在时一并创建，逐级mkdirat并且不跟随软链接
+func MkdirAll(root string, name string, perm os.FileMode) error {
+	real, err := Resolve(root, name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(root, perm); err != nil {
+		return err
+	}
+	dirfd, err := openRoot(root)
+	if err != nil {
+		return err
+	}
+	dirfd, err = walkDirs(dirfd, real, components(root, real), true, perm)
+	if err != nil {
+		return err
+	}
+	return syscall.Close(dirfd)
+}
+
+// ResolveNoFollow 与Resolve相同，但是不解析最后一级的软链接，返回软链接本身的路径
+// 删除、重命名、移动等操作的是链接本身，而不是链接指向的文件
+func ResolveNoFollow(root string, name string) (string, error) {
+	joined := filepath.Join(root, filepath.FromSlash(name))
+	if !Within(root, joined) {
+		return "", ErrEscape
+	}
+	if joined == root {
+		return root, nil
+	}
+	parent, err := Resolve(root, Rel(root, filepath.Dir(joined)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(joined)), nil
+}
+
+// 逐级打开path的父目录，返回父目录的fd和最后一级的名称，path必须是ResolveNoFollow的返回值并且不能是root本身
+func openParent(root string, path string) (int, string, error) {
+	names := components(root, path)
+	if len(names) == 0 {
+		return -1, "", ErrEscape
+	}
+	dirfd, err := openRoot(root)
+	if err != nil {
+		return -1, "", err
+	}
+	dirfd, err = walkDirs(dirfd, path, names[:len(names)-1], false, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	return dirfd, names[len(names)-1], nil
+}
+
+// 在dirfd中打开目录，不跟随软链接
+func openDirAt(dirfd int, name string) (*os.File, error) {
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// Rename 把root中的name移动到newRoot中的newName，两者都不跟随最后一级的软链接
+// 目标已存在时返回EEXIST，不会覆盖；跨磁盘时返回EXDEV，由调用方决定是否复制
+func Rename(root string, name string, newRoot string, newName string) error {
+	oldPath, err := ResolveNoFollow(root, name)
+	if err != nil {
+		return err
+	}
+	newPath, err := ResolveNoFollow(newRoot, newName)
+	if err != nil {
+		return err
+	}
+	olddirfd, oldBase, err := openParent(root, oldPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(olddirfd)
+	newdirfd, newBase, err := openParent(newRoot, newPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(newdirfd)
+	err = unix.Renameat2(olddirfd, oldBase, newdirfd, newBase, unix.RENAME_NOREPLACE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		// 文件系统不支持RENAME_NOREPLACE时，先检查目标是否存在
+		var st unix.Stat_t
+		if err = unix.Fstatat(newdirfd, newBase, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+			err = unix.EEXIST
+		} else if err == unix.ENOENT {
+			err = unix.Renameat(olddirfd, oldBase, newdirfd, newBase)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "renameat", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// RemoveAll 删除root中的文件或目录，不跟随软链接，目录中的内容逐级通过unlinkat删除
+func RemoveAll(root string, name string) error {
+	path, err := ResolveNoFollow(root, name)
+	if err != nil {
+		return err
+	}
+	dirfd, base, err := openParent(root, path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	if err = removeAllAt(dirfd, base); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: path, Err: err}
+	}
+	return nil
+}
+
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR && err != unix.EPERM {
+		return err
+	}
+	dir, err := openDirAt(dirfd, name)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	if err == nil {
+		for _, n := range names {
+			if err = removeAllAt(int(dir.Fd()), n); err != nil {
+				break
+			}
+		}
+	}
+	_ = dir.Close()
+	if err != nil {
+		return err
+	}
+	return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
+
+// CopyAll 把root中的name递归复制到newRoot中的newName，目标已存在时返回EEXIST
+// 软链接按原样复制链接本身，不会读取链接指向的内容，设备文件等特殊文件会被跳过
+func CopyAll(root string, name string, newRoot string, newName string) error {
+	srcPath, err := ResolveNoFollow(root, name)
+	if err != nil {
+		return err
+	}
+	dstPath, err := ResolveNoFollow(newRoot, newName)
+	if err != nil {
+		return err
+	}
+	srcdirfd, srcBase, err := openParent(root, srcPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(srcdirfd)
+	dstdirfd, dstBase, err := openParent(newRoot, dstPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dstdirfd)
+	if err = copyAt(srcdirfd, srcBase, dstdirfd, dstBase); err != nil {
+		return &os.LinkError{Op: "copy", Old: srcPath, New: dstPath, Err: err}
+	}
+	return nil
+}
+
+func copyAt(srcdirfd int, srcName string, dstdirfd int, dstName string) error {
+	var st unix.Stat_t
+	if err := unix.Fstatat(srcdirfd, srcName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	perm := st.Mode & 0777
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		if err := unix.Mkdirat(dstdirfd, dstName, perm); err != nil {
+			return err
+		}
+		src, err := openDirAt(srcdirfd, srcName)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := openDirAt(dstdirfd, dstName)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		names, err := src.Readdirnames(-1)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err = copyAt(int(src.Fd()), n, int(dst.Fd()), n); err != nil {
+				return err
+			}
+		}
+		return nil
+	case unix.S_IFLNK:
+		buf := make([]byte, 256)
+		for {
+			n, err := unix.Readlinkat(srcdirfd, srcName, buf)
+			if err != nil {
+				return err
+			}
+			if n < len(buf) {
+				return unix.Symlinkat(string(buf[:n]), dstdirfd, dstName)
+			}
+			buf = make([]byte, len(buf)*2)
+		}
+	case unix.S_IFREG:
+		// O_NONBLOCK避免文件在这期间被替换成fifo时阻塞
+		infd, err := unix.Openat(srcdirfd, srcName, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		in := os.NewFile(uintptr(infd), srcName)
+		defer in.Close()
+		outfd, err := unix.Openat(dstdirfd, dstName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, perm)
+		if err != nil {
+			return err
+		}
+		out := os.NewFile(uintptr(outfd), dstName)
+		_, err = io.Copy(out, in)
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		return err
+	}
+	return nil
+}
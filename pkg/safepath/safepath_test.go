@@ -0,0 +1,330 @@
+package safepath
+
+import (
+	"github.com/gogf/gf/test/gtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 创建测试用的目录结构
+// base/outside/secret.txt
+// base/root/a/b.txt
+// base/root/in-link -> a
+// base/root/file-link -> a/b.txt
+// base/root/out-link -> ../outside
+// base/root/abs-link -> base/outside/secret.txt
+// base/root/chain-link -> out-link
+// base/root/dangling -> ../outside/new.txt
+// base/root/loop -> loop
+// base/root-evil/x.txt
+// base/root-link -> root
+func setup(t *gtest.T) (base string, root string) {
+	base, err := ioutil.TempDir("", "safepath")
+	t.Assert(err, nil)
+	base, err = filepath.EvalSymlinks(base)
+	t.Assert(err, nil)
+	root = filepath.Join(base, "root")
+	t.Assert(os.MkdirAll(filepath.Join(root, "a"), 0755), nil)
+	t.Assert(os.MkdirAll(filepath.Join(base, "outside"), 0755), nil)
+	t.Assert(os.MkdirAll(filepath.Join(base, "root-evil"), 0755), nil)
+	t.Assert(ioutil.WriteFile(filepath.Join(root, "a", "b.txt"), []byte("b"), 0644), nil)
+	t.Assert(ioutil.WriteFile(filepath.Join(base, "outside", "secret.txt"), []byte("secret"), 0644), nil)
+	t.Assert(ioutil.WriteFile(filepath.Join(base, "root-evil", "x.txt"), []byte("x"), 0644), nil)
+	t.Assert(os.Symlink("a", filepath.Join(root, "in-link")), nil)
+	t.Assert(os.Symlink("a/b.txt", filepath.Join(root, "file-link")), nil)
+	t.Assert(os.Symlink("../outside", filepath.Join(root, "out-link")), nil)
+	t.Assert(os.Symlink(filepath.Join(base, "outside", "secret.txt"), filepath.Join(root, "abs-link")), nil)
+	t.Assert(os.Symlink("out-link", filepath.Join(root, "chain-link")), nil)
+	t.Assert(os.Symlink("../outside/new.txt", filepath.Join(root, "dangling")), nil)
+	t.Assert(os.Symlink("loop", filepath.Join(root, "loop")), nil)
+	t.Assert(os.Symlink("root", filepath.Join(base, "root-link")), nil)
+	return base, root
+}
+
+func TestWithin(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		t.Assert(Within("/home/u/Downloads", "/home/u/Downloads"), true)
+		t.Assert(Within("/home/u/Downloads", "/home/u/Downloads/"), true)
+		t.Assert(Within("/home/u/Downloads", "/home/u/Downloads/a/b"), true)
+		t.Assert(Within("/home/u/Downloads/", "/home/u/Downloads/a"), true)
+		t.Assert(Within("/home/u/Downloads", "/home/u/Downloads-evil"), false)
+		t.Assert(Within("/home/u/Downloads", "/home/u/Downloads-evil/a"), false)
+		t.Assert(Within("/home/u/Downloads", "/home/u"), false)
+		t.Assert(Within("/home/u/Downloads", "/home/u/Downloads/../x"), false)
+		t.Assert(Within("/", "/etc/passwd"), true)
+	})
+}
+
+func TestResolve_Traversal(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		escapes := []string{
+			"..",
+			"../",
+			"../outside/secret.txt",
+			"a/../../outside/secret.txt",
+			"a/../../../../../../etc/passwd",
+			"../root-evil/x.txt",
+			"./../root-evil",
+			"out-link",
+			"out-link/secret.txt",
+			"abs-link",
+			"chain-link/secret.txt",
+			"dangling",
+			"loop",
+			"loop/x",
+		}
+		for _, name := range escapes {
+			_, err := Resolve(root, name)
+			t.AssertNE(err, nil)
+		}
+
+		cases := map[string]string{
+			"":                    root,
+			"/":                   root,
+			".":                   root,
+			"a":                   filepath.Join(root, "a"),
+			"/a/b.txt":            filepath.Join(root, "a", "b.txt"),
+			"a/./b.txt":           filepath.Join(root, "a", "b.txt"),
+			"a/../a/b.txt":        filepath.Join(root, "a", "b.txt"),
+			"in-link/b.txt":       filepath.Join(root, "a", "b.txt"),
+			"file-link":           filepath.Join(root, "a", "b.txt"),
+			"new/dir/file.txt":    filepath.Join(root, "new", "dir", "file.txt"),
+			"in-link/new.txt":     filepath.Join(root, "a", "new.txt"),
+			"/etc/passwd":         filepath.Join(root, "etc", "passwd"),
+			"a//b.txt":            filepath.Join(root, "a", "b.txt"),
+			"in-link/../a/b.txt":  filepath.Join(root, "a", "b.txt"),
+			"a/b.txt/../../a":     filepath.Join(root, "a"),
+			"中文目录/文件.txt":         filepath.Join(root, "中文目录", "文件.txt"),
+			"out-link/../a/b.txt": filepath.Join(root, "a", "b.txt"),
+		}
+		for name, expect := range cases {
+			path, err := Resolve(root, name)
+			t.Assert(err, nil)
+			t.Assert(path, expect)
+		}
+	})
+}
+
+func TestEvalRoot(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		// 根目录本身是软链接时使用链接指向的真实目录
+		r, err := EvalRoot(filepath.Join(base, "root-link"))
+		t.Assert(err, nil)
+		t.Assert(r, root)
+		path, err := Resolve(r, "in-link/b.txt")
+		t.Assert(err, nil)
+		t.Assert(path, filepath.Join(root, "a", "b.txt"))
+		t.Assert(Rel(r, path), "/a/b.txt")
+
+		// 根目录可以还不存在
+		r, err = EvalRoot(filepath.Join(base, "root-link", "missing"))
+		t.Assert(err, nil)
+		t.Assert(r, filepath.Join(root, "missing"))
+	})
+}
+
+func TestRel(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		t.Assert(Rel("/home/u/Downloads", "/home/u/Downloads"), "/")
+		t.Assert(Rel("/home/u/Downloads", "/home/u/Downloads/a/b"), "/a/b")
+		t.Assert(Rel("/home/u/Downloads", "/home/u/Downloads-evil/a"), "/")
+	})
+}
+
+func TestOpenFile(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		f, err := Open(root, "in-link/b.txt")
+		t.Assert(err, nil)
+		data, err := ioutil.ReadAll(f)
+		t.Assert(err, nil)
+		t.Assert(string(data), "b")
+		t.Assert(f.Close(), nil)
+
+		for _, name := range []string{"out-link/secret.txt", "abs-link", "../outside/secret.txt", "dangling"} {
+			_, err = Open(root, name)
+			t.AssertNE(err, nil)
+		}
+
+		// 不能通过指向外部的软链接创建文件
+		_, err = OpenFile(root, "dangling", os.O_WRONLY|os.O_CREATE, 0644)
+		t.AssertNE(err, nil)
+		t.Assert(fileExists(filepath.Join(base, "outside", "new.txt")), false)
+
+		f, err = OpenFile(root, "a/c.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		t.Assert(err, nil)
+		t.Assert(f.Close(), nil)
+		info, err := os.Stat(filepath.Join(root, "a", "c.txt"))
+		t.Assert(err, nil)
+		t.Assert(info.Mode().Perm(), os.FileMode(0600))
+
+		// 根目录只能以只读方式打开
+		f, err = Open(root, "/")
+		t.Assert(err, nil)
+		t.Assert(f.Close(), nil)
+		_, err = OpenFile(root, "/", os.O_WRONLY, 0)
+		t.AssertNE(err, nil)
+	})
+}
+
+func TestOpenFile_NoFollow(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		// 模拟校验之后路径中的某一级被替换成软链接，逐级openat时必须失败
+		real, err := Resolve(root, "a/b.txt")
+		t.Assert(err, nil)
+		dirfd, err := openRoot(root)
+		t.Assert(err, nil)
+		t.Assert(os.Rename(filepath.Join(root, "a"), filepath.Join(root, "a-moved")), nil)
+		t.Assert(os.Symlink("../outside", filepath.Join(root, "a")), nil)
+		_, err = walkDirs(dirfd, real, components(root, filepath.Join(root, "a")), false, 0)
+		t.AssertNE(err, nil)
+
+		_, err = Open(root, "file-link")
+		t.AssertNE(err, nil)
+	})
+}
+
+func TestMkdirAll(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		t.Assert(MkdirAll(root, "x/y/z", 0755), nil)
+		t.Assert(dirExists(filepath.Join(root, "x", "y", "z")), true)
+		t.Assert(MkdirAll(root, "x/y/z", 0755), nil)
+		t.Assert(MkdirAll(root, "in-link/sub", 0755), nil)
+		t.Assert(dirExists(filepath.Join(root, "a", "sub")), true)
+
+		t.AssertNE(MkdirAll(root, "out-link/sub", 0755), nil)
+		t.AssertNE(MkdirAll(root, "../outside/sub", 0755), nil)
+		t.Assert(dirExists(filepath.Join(base, "outside", "sub")), false)
+
+		// 根目录不存在时自动创建
+		missing := filepath.Join(base, "missing-root")
+		t.Assert(MkdirAll(missing, "a", 0755), nil)
+		t.Assert(dirExists(filepath.Join(missing, "a")), true)
+	})
+}
+
+func TestResolveNoFollow(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		// 最后一级的软链接不解析，父目录中的软链接照常解析
+		path, err := ResolveNoFollow(root, "out-link")
+		t.Assert(err, nil)
+		t.Assert(path, filepath.Join(root, "out-link"))
+		path, err = ResolveNoFollow(root, "in-link/b.txt")
+		t.Assert(err, nil)
+		t.Assert(path, filepath.Join(root, "a", "b.txt"))
+		path, err = ResolveNoFollow(root, "/")
+		t.Assert(err, nil)
+		t.Assert(path, root)
+		_, err = ResolveNoFollow(root, "out-link/secret.txt")
+		t.Assert(err, ErrEscape)
+		_, err = ResolveNoFollow(root, "../outside")
+		t.Assert(err, ErrEscape)
+	})
+}
+
+func TestRemoveAll(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		// 删除软链接时只删除链接本身
+		t.Assert(RemoveAll(root, "out-link"), nil)
+		t.Assert(fileExists(filepath.Join(root, "out-link")), false)
+		t.Assert(fileExists(filepath.Join(base, "outside", "secret.txt")), true)
+		t.Assert(RemoveAll(root, "in-link"), nil)
+		t.Assert(fileExists(filepath.Join(root, "a", "b.txt")), true)
+
+		t.Assert(MkdirAll(root, "a/x/y", 0755), nil)
+		t.Assert(os.Symlink("../../../outside", filepath.Join(root, "a", "x", "link")), nil)
+		t.Assert(RemoveAll(root, "a"), nil)
+		t.Assert(fileExists(filepath.Join(root, "a")), false)
+		t.Assert(fileExists(filepath.Join(base, "outside", "secret.txt")), true)
+
+		t.AssertNE(RemoveAll(root, "chain-link/secret.txt"), nil)
+		t.AssertNE(RemoveAll(root, "/"), nil)
+		t.Assert(RemoveAll(root, "not-exist"), nil)
+	})
+}
+
+func TestRename(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		// 重命名软链接时移动的是链接本身
+		t.Assert(Rename(root, "file-link", root, "a/file-link"), nil)
+		link, err := os.Readlink(filepath.Join(root, "a", "file-link"))
+		t.Assert(err, nil)
+		t.Assert(link, "a/b.txt")
+		t.Assert(fileExists(filepath.Join(root, "a", "b.txt")), true)
+
+		// 目标已存在时不覆盖
+		t.Assert(ioutil.WriteFile(filepath.Join(root, "c.txt"), []byte("c"), 0644), nil)
+		err = Rename(root, "c.txt", root, "a/b.txt")
+		t.Assert(os.IsExist(err), true)
+		data, _ := ioutil.ReadFile(filepath.Join(root, "a", "b.txt"))
+		t.Assert(string(data), "b")
+
+		// 不能移动到根目录之外
+		t.AssertNE(Rename(root, "c.txt", root, "out-link/c.txt"), nil)
+		t.Assert(fileExists(filepath.Join(base, "outside", "c.txt")), false)
+		t.Assert(Rename(root, "c.txt", filepath.Join(base, "outside"), "c.txt"), nil)
+		t.Assert(fileExists(filepath.Join(base, "outside", "c.txt")), true)
+	})
+}
+
+func TestCopyAll(t *testing.T) {
+	gtest.C(t, func(t *gtest.T) {
+		base, root := setup(t)
+		defer os.RemoveAll(base)
+
+		t.Assert(os.Symlink("../../outside/secret.txt", filepath.Join(root, "a", "secret-link")), nil)
+		t.Assert(CopyAll(root, "a", root, "copy"), nil)
+		data, err := ioutil.ReadFile(filepath.Join(root, "copy", "b.txt"))
+		t.Assert(err, nil)
+		t.Assert(string(data), "b")
+		// 软链接按原样复制，不读取链接指向的内容
+		link, err := os.Readlink(filepath.Join(root, "copy", "secret-link"))
+		t.Assert(err, nil)
+		t.Assert(link, "../../outside/secret.txt")
+
+		t.Assert(CopyAll(root, "abs-link", root, "abs-copy"), nil)
+		info, err := os.Lstat(filepath.Join(root, "abs-copy"))
+		t.Assert(err, nil)
+		t.Assert(info.Mode()&os.ModeSymlink != 0, true)
+
+		err = CopyAll(root, "a", root, "copy")
+		t.Assert(os.IsExist(err), true)
+		t.AssertNE(CopyAll(root, "a", root, "out-link/copy"), nil)
+		t.Assert(fileExists(filepath.Join(base, "outside", "copy")), false)
+	})
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func dirExists(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.IsDir()
+}